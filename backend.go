@@ -0,0 +1,577 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/charmbracelet/log"
+	"github.com/newrelic/go-agent/v3/newrelic"
+)
+
+/*
+ * Backends
+ *
+ * A backend is where the data about a run ends up. Each run records a single
+ * transaction, annotated with attributes, which is sent when the backend is
+ * shut down.
+ */
+
+// Backend records transactions to a telemetry service
+type Backend interface {
+	// StartTransaction starts timing a new named transaction
+	StartTransaction(name string) Transaction
+	// WaitForConnection blocks until the backend is ready to record data
+	WaitForConnection(timeout time.Duration) error
+	// Shutdown sends any recorded data, waiting up to timeout
+	Shutdown(timeout time.Duration)
+	// ShutdownContext sends any recorded data like Shutdown, until ctx's
+	// deadline, but returns ctx.Err() early if ctx is done first
+	ShutdownContext(ctx context.Context) error
+}
+
+// defaultShutdownTimeout is how long ShutdownContext gives a backend when ctx
+// has no deadline
+const defaultShutdownTimeout = 60 * time.Second
+
+// shutdownContext runs shutdown in the background for ShutdownContext,
+// warning that what was lost may have been dropped if ctx is done first. The
+// shutdown carries on in the background after that, until the process exits.
+func shutdownContext(ctx context.Context, shutdown func(timeout time.Duration), lost string) error {
+	timeout := defaultShutdownTimeout
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = time.Until(deadline)
+	}
+
+	began := time.Now()
+	done := make(chan struct{})
+	go func() {
+		shutdown(timeout)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		log.Warn("Backend shutdown interrupted, "+lost+" may be dropped", "after", time.Since(began).Round(time.Millisecond), "err", ctx.Err())
+		return ctx.Err()
+	}
+}
+
+// Transaction is a single timed and annotated run
+type Transaction interface {
+	AddAttribute(key string, value interface{})
+	StartSegment(name string) Segment
+	NoticeError(err error)
+	// AcceptTraceContext makes the transaction a child of the W3C trace
+	// context given by the traceparent and tracestate headers
+	AcceptTraceContext(traceparent, tracestate string)
+	// RecordSpan records work which already happened as part of the
+	// transaction
+	RecordSpan(span Span)
+	// LinkTrace links the transaction to a trace started elsewhere, which it
+	// isn't a child of
+	LinkTrace(traceID string)
+	// RecordMetric records a named value measured for the run, outside of
+	// its attributes, so it can be charted across runs
+	RecordMetric(name string, value float64)
+	End()
+}
+
+// Span is a timed portion of a Transaction which already happened, such as a
+// job step, so it can't be timed as a Segment
+type Span struct {
+	Name     string
+	Start    time.Time
+	Duration time.Duration
+}
+
+// Segment is a timed portion of a Transaction
+type Segment interface {
+	End()
+}
+
+// noopSegment is a Segment for backends which don't record segments
+type noopSegment struct{}
+
+func (noopSegment) End() {}
+
+// renamedTransaction renames attributes before passing them on, prefixing all
+// of them and renaming some. Attributes the backend adds itself are untouched.
+type renamedTransaction struct {
+	Transaction
+	prefix  string
+	renames map[string]string // renames maps our attribute names to theirs
+}
+
+func (txn *renamedTransaction) AddAttribute(key string, value interface{}) {
+	if renamed, ok := txn.renames[key]; ok {
+		key = renamed
+	}
+	txn.Transaction.AddAttribute(txn.prefix+key, value)
+}
+
+// NewRelic's limits on custom attributes. Past them it truncates values and
+// drops attributes without telling us, so we enforce them ourselves.
+const (
+	maxAttributeLength = 255 // maxAttributeLength is in bytes
+	maxAttributes      = 64
+)
+
+// truncatedMarker ends values we've truncated, so it's clear they're partial
+const truncatedMarker = "..."
+
+// limitedTransaction enforces attribute limits before passing attributes on,
+// truncating long strings and dropping attributes past the limit, then warns
+// about everything it changed when the transaction ends.
+type limitedTransaction struct {
+	Transaction
+	keys      map[string]bool // keys are the attributes we've passed on
+	truncated map[string]bool
+	dropped   map[string]bool
+	m         sync.Mutex // m protects our maps
+}
+
+// limitAttributes returns txn with NewRelic's attribute limits enforced
+func limitAttributes(txn Transaction) Transaction {
+	return &limitedTransaction{
+		Transaction: txn,
+		keys:        map[string]bool{},
+		truncated:   map[string]bool{},
+		dropped:     map[string]bool{},
+	}
+}
+
+func (txn *limitedTransaction) AddAttribute(key string, value interface{}) {
+	txn.m.Lock()
+	if !txn.keys[key] && len(txn.keys) >= maxAttributes {
+		txn.dropped[key] = true
+		txn.m.Unlock()
+		return
+	}
+	txn.keys[key] = true
+	if s, ok := value.(string); ok && len(s) > maxAttributeLength {
+		value = truncateAttribute(s)
+		txn.truncated[key] = true
+	}
+	txn.m.Unlock()
+	txn.Transaction.AddAttribute(key, value)
+}
+
+// traceAttributeLinker is a Transaction which links traces by recording them
+// as an attribute, which has to be limited like any other
+type traceAttributeLinker interface {
+	linkAttribute() string
+}
+
+func (txn *limitedTransaction) LinkTrace(traceID string) {
+	if linker, ok := txn.Transaction.(traceAttributeLinker); ok {
+		txn.AddAttribute(linker.linkAttribute(), traceID)
+		return
+	}
+	txn.Transaction.LinkTrace(traceID)
+}
+
+func (txn *limitedTransaction) End() {
+	txn.m.Lock()
+	if len(txn.truncated) > 0 {
+		log.Warn("Attribute values truncated to fit backend limits", "keys", sortedKeys(txn.truncated), "maxLength", maxAttributeLength)
+	}
+	if len(txn.dropped) > 0 {
+		log.Warn("Attributes dropped to fit backend limits", "keys", sortedKeys(txn.dropped), "maxAttributes", maxAttributes)
+	}
+	txn.m.Unlock()
+	txn.Transaction.End()
+}
+
+// truncateAttribute cuts s down to maxAttributeLength bytes, marker included,
+// without splitting a UTF-8 character
+func truncateAttribute(s string) string {
+	cut := maxAttributeLength - len(truncatedMarker)
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + truncatedMarker
+}
+
+// sortedKeys returns the keys of set, sorted and comma separated
+func sortedKeys(set map[string]bool) string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
+/*
+ * NewRelic backend
+ */
+
+// newRelicBackend records transactions to NewRelic APM
+type newRelicBackend struct {
+	app *newrelic.Application
+}
+
+// NewNewRelicBackend returns a Backend which records to the NewRelic app
+func NewNewRelicBackend(app *newrelic.Application) Backend {
+	return &newRelicBackend{app: app}
+}
+
+func (b *newRelicBackend) StartTransaction(name string) Transaction {
+	txn := b.app.StartTransaction(name)
+	if txn.Name() == "" {
+		log.Warn("No name set on Transaction instance, implying it is misconfigured")
+	}
+	return limitAttributes(&newRelicTransaction{txn})
+}
+
+func (b *newRelicBackend) WaitForConnection(timeout time.Duration) error {
+	return b.app.WaitForConnection(timeout)
+}
+
+func (b *newRelicBackend) Shutdown(timeout time.Duration) {
+	b.app.Shutdown(timeout)
+}
+
+func (b *newRelicBackend) ShutdownContext(ctx context.Context) error {
+	return shutdownContext(ctx, b.Shutdown, "the transaction and step events not yet sent to NewRelic")
+}
+
+// newRelicTransaction adapts a NewRelic transaction to our Transaction
+type newRelicTransaction struct {
+	*newrelic.Transaction
+}
+
+func (txn *newRelicTransaction) StartSegment(name string) Segment {
+	return txn.Transaction.StartSegment(name)
+}
+
+// AcceptTraceContext accepts the trace context as if it came in on headers,
+// which needs distributed tracing enabled on the app
+func (txn *newRelicTransaction) AcceptTraceContext(traceparent, tracestate string) {
+	headers := http.Header{}
+	headers.Set("traceparent", traceparent)
+	if tracestate != "" {
+		headers.Set("tracestate", tracestate)
+	}
+	txn.AcceptDistributedTraceHeaders(newrelic.TransportOther, headers)
+}
+
+// LinkTrace records the trace ID as the linked_trace_id attribute. NewRelic
+// has no span links, so the transaction is still a root of its own trace.
+func (txn *newRelicTransaction) LinkTrace(traceID string) {
+	txn.AddAttribute(txn.linkAttribute(), traceID)
+}
+
+// linkAttribute is the attribute LinkTrace records, so limitedTransaction can
+// limit it like any other
+func (txn *newRelicTransaction) linkAttribute() string {
+	return "linked_trace_id"
+}
+
+// RecordSpan records the span as a custom event, since segments can't be
+// backdated, linked to the transaction by its name and trace ID
+func (txn *newRelicTransaction) RecordSpan(span Span) {
+	txn.Application().RecordCustomEvent("GitHubStep", map[string]interface{}{
+		"name":        span.Name,
+		"start":       span.Start.UnixMilli(),
+		"duration":    span.Duration.Seconds(),
+		"transaction": txn.Name(),
+		"trace_id":    txn.GetTraceMetadata().TraceID,
+	})
+}
+
+// RecordMetric records the value as a custom metric on the app. Metrics
+// aren't tied to the transaction, so they're aggregated across runs.
+func (txn *newRelicTransaction) RecordMetric(name string, value float64) {
+	txn.Application().RecordCustomMetric(name, value)
+}
+
+/*
+ * Writer backend
+ */
+
+// writerBackend writes each transaction to an io.Writer as a line of JSON
+type writerBackend struct {
+	w      io.Writer
+	closer io.Closer  // closer is closed on shutdown, if we opened the writer
+	m      sync.Mutex // m serializes writes so records don't interleave
+}
+
+// writerRecord is the JSON line written for each transaction
+type writerRecord struct {
+	Name       string                 `json:"name"`
+	Start      time.Time              `json:"start"`
+	Duration   float64                `json:"duration"` // Duration is in seconds
+	Attributes map[string]interface{} `json:"attributes"`
+	Errors     []string               `json:"errors,omitempty"`
+	Parent     string                 `json:"parent,omitempty"` // Parent is the accepted traceparent
+	Spans      []writerSpan           `json:"spans,omitempty"`
+	Links      []string               `json:"links,omitempty"` // Links are linked trace IDs
+	Metrics    map[string]float64     `json:"metrics,omitempty"`
+}
+
+// writerSpan is the JSON for each recorded Span
+type writerSpan struct {
+	Name     string    `json:"name"`
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"` // Duration is in seconds
+}
+
+// NewWriterBackend returns a Backend which writes each transaction to w as a
+// line of JSON, suitable for piping into other tools.
+func NewWriterBackend(w io.Writer) Backend {
+	return &writerBackend{w: w}
+}
+
+func (b *writerBackend) StartTransaction(name string) Transaction {
+	return &writerTransaction{
+		backend: b,
+		record: writerRecord{
+			Name:       name,
+			Start:      time.Now(),
+			Attributes: map[string]interface{}{},
+		},
+	}
+}
+
+func (b *writerBackend) WaitForConnection(timeout time.Duration) error {
+	return nil
+}
+
+// Shutdown closes the writer if we opened it, since records are written as
+// soon as their transaction ends
+func (b *writerBackend) Shutdown(timeout time.Duration) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	if b.closer != nil {
+		b.closer.Close()
+		b.closer = nil
+	}
+}
+
+func (b *writerBackend) ShutdownContext(ctx context.Context) error {
+	return shutdownContext(ctx, b.Shutdown, "output not yet flushed by closing it")
+}
+
+// write encodes record as a single JSON line
+func (b *writerBackend) write(record writerRecord) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	err := json.NewEncoder(b.w).Encode(record)
+	if err != nil {
+		log.Error("Could not write transaction", "err", err)
+	}
+}
+
+// writerTransaction collects attributes until it's ended
+type writerTransaction struct {
+	backend *writerBackend
+	record  writerRecord
+	ended   bool
+	m       sync.Mutex // m protects the record from concurrent access
+}
+
+func (txn *writerTransaction) AddAttribute(key string, value interface{}) {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	txn.record.Attributes[key] = value
+}
+
+// StartSegment returns a no-op Segment, since we only record the totals
+func (txn *writerTransaction) StartSegment(name string) Segment {
+	return noopSegment{}
+}
+
+func (txn *writerTransaction) NoticeError(err error) {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	txn.record.Errors = append(txn.record.Errors, err.Error())
+}
+
+// AcceptTraceContext records the traceparent so records can be linked to it
+func (txn *writerTransaction) AcceptTraceContext(traceparent, tracestate string) {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	txn.record.Parent = traceparent
+}
+
+func (txn *writerTransaction) LinkTrace(traceID string) {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	txn.record.Links = append(txn.record.Links, traceID)
+}
+
+func (txn *writerTransaction) RecordSpan(span Span) {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	txn.record.Spans = append(txn.record.Spans, writerSpan{
+		Name:     span.Name,
+		Start:    span.Start,
+		Duration: span.Duration.Seconds(),
+	})
+}
+
+func (txn *writerTransaction) RecordMetric(name string, value float64) {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	if txn.record.Metrics == nil {
+		txn.record.Metrics = map[string]float64{}
+	}
+	txn.record.Metrics[name] = value
+}
+
+func (txn *writerTransaction) End() {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	if txn.ended {
+		return
+	}
+	txn.ended = true
+	txn.record.Duration = time.Since(txn.record.Start).Seconds()
+	// Spans may be recorded concurrently, so put them back in order
+	sort.SliceStable(txn.record.Spans, func(i, j int) bool {
+		a, b := txn.record.Spans[i], txn.record.Spans[j]
+		if !a.Start.Equal(b.Start) {
+			return a.Start.Before(b.Start)
+		}
+		return a.Name < b.Name
+	})
+	txn.backend.write(txn.record)
+}
+
+/*
+ * Multi backend
+ */
+
+// multiBackend records each transaction to several backends at once
+type multiBackend struct {
+	backends []Backend
+}
+
+// NewMultiBackend returns a Backend which records to every one of backends.
+// A backend which can't connect or shut down doesn't stop the others getting
+// data.
+func NewMultiBackend(backends ...Backend) Backend {
+	return &multiBackend{backends: backends}
+}
+
+func (b *multiBackend) StartTransaction(name string) Transaction {
+	txn := &multiTransaction{}
+	for _, backend := range b.backends {
+		txn.txns = append(txn.txns, backend.StartTransaction(name))
+	}
+	return txn
+}
+
+// WaitForConnection waits for every backend at once, returning all their
+// errors together
+func (b *multiBackend) WaitForConnection(timeout time.Duration) error {
+	errs := make([]error, len(b.backends))
+	b.each(func(i int, backend Backend) {
+		errs[i] = backend.WaitForConnection(timeout)
+	})
+	return errors.Join(errs...)
+}
+
+// Shutdown shuts every backend down at once, so a slow one doesn't eat into
+// the others' timeout
+func (b *multiBackend) Shutdown(timeout time.Duration) {
+	b.each(func(i int, backend Backend) {
+		backend.Shutdown(timeout)
+	})
+}
+
+func (b *multiBackend) ShutdownContext(ctx context.Context) error {
+	errs := make([]error, len(b.backends))
+	b.each(func(i int, backend Backend) {
+		errs[i] = backend.ShutdownContext(ctx)
+	})
+	return errors.Join(errs...)
+}
+
+// each calls f for every backend concurrently, returning once they're done
+func (b *multiBackend) each(f func(i int, backend Backend)) {
+	var wg sync.WaitGroup
+	for i, backend := range b.backends {
+		wg.Add(1)
+		go func(i int, backend Backend) {
+			defer wg.Done()
+			f(i, backend)
+		}(i, backend)
+	}
+	wg.Wait()
+}
+
+// multiTransaction forwards everything to a transaction in each backend
+type multiTransaction struct {
+	txns []Transaction
+}
+
+func (txn *multiTransaction) AddAttribute(key string, value interface{}) {
+	for _, t := range txn.txns {
+		t.AddAttribute(key, value)
+	}
+}
+
+func (txn *multiTransaction) StartSegment(name string) Segment {
+	segment := multiSegment{}
+	for _, t := range txn.txns {
+		segment = append(segment, t.StartSegment(name))
+	}
+	return segment
+}
+
+func (txn *multiTransaction) NoticeError(err error) {
+	for _, t := range txn.txns {
+		t.NoticeError(err)
+	}
+}
+
+func (txn *multiTransaction) AcceptTraceContext(traceparent, tracestate string) {
+	for _, t := range txn.txns {
+		t.AcceptTraceContext(traceparent, tracestate)
+	}
+}
+
+func (txn *multiTransaction) RecordSpan(span Span) {
+	for _, t := range txn.txns {
+		t.RecordSpan(span)
+	}
+}
+
+func (txn *multiTransaction) LinkTrace(traceID string) {
+	for _, t := range txn.txns {
+		t.LinkTrace(traceID)
+	}
+}
+
+func (txn *multiTransaction) RecordMetric(name string, value float64) {
+	for _, t := range txn.txns {
+		t.RecordMetric(name, value)
+	}
+}
+
+func (txn *multiTransaction) End() {
+	for _, t := range txn.txns {
+		t.End()
+	}
+}
+
+// multiSegment ends a segment in each backend
+type multiSegment []Segment
+
+func (s multiSegment) End() {
+	for _, segment := range s {
+		segment.End()
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/charmbracelet/log"
+)
+
+/*
+ * Control endpoint
+ *
+ * An optional HTTP server for start, for when stop can't reach the flag file,
+ * e.g. from another container. Stopping over HTTP releases the flag, which for
+ * a flag file removes it, so it ends the transaction exactly like the stop
+ * command does.
+ */
+
+// controlShutdownTimeout is how long we let requests finish on shutdown
+const controlShutdownTimeout = 5 * time.Second
+
+// startControlServer listens on addr, serving POST /stop by releasing flag.
+// Listening happens before it returns, so a bad address is an error here
+// rather than in the background.
+func startControlServer(addr string, flag Flag) (shutdown func(), err error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stop", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		log.Info("Stop requested over HTTP", "remote", r.RemoteAddr)
+		// Releasing a flag which is already gone is still a stop
+		err := flag.Release()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("could not release flag: %s", err), http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintln(w, "stopping")
+	})
+
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		err := server.Serve(listener)
+		if err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Error("Control server failed", "err", err)
+		}
+	}()
+	log.Debug("Control server listening", "addr", listener.Addr())
+
+	shutdown = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), controlShutdownTimeout)
+		defer cancel()
+		err := server.Shutdown(ctx)
+		if err != nil {
+			log.Warn("Could not shut down control server", "err", err)
+		}
+	}
+	return
+}
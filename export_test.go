@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io"
+	"time"
+
+	"github.com/google/go-github/v55/github"
+)
+
+// SetGitHubClient lets tests point the start command at a stubbed API
+func (start *CliStart) SetGitHubClient(client *github.Client) {
+	start.client = client
+}
+
+// SetGitHubBaseURL lets tests point the GitHub App authentication at a
+// stubbed API
+func (start *CliStart) SetGitHubBaseURL(baseURL string) {
+	start.baseURL = baseURL
+}
+
+// SetGitHubActions lets tests replace the GitHub Actions API with a fake
+func (start *CliStart) SetGitHubActions(actions GitHubActions) {
+	start.actions = actions
+}
+
+// SetFlag lets tests drive the start command with a Flag instead of the flag
+// file
+func (start *CliStart) SetFlag(flag Flag) {
+	start.flag = flag
+}
+
+// NewClosingWriterBackend lets tests see, and hold up, the writer backend
+// closing its writer on shutdown
+func NewClosingWriterBackend(w io.Writer, closer io.Closer) Backend {
+	return &writerBackend{w: w, closer: closer}
+}
+
+// SetOutput lets tests read the watch command's stages as they're printed
+func (watch *CliWatch) SetOutput(w io.Writer) {
+	watch.out = w
+}
+
+// TouchFile lets tests create flag files directly
+var TouchFile = touchFile
+
+// StartupJitterDelay lets tests see the random startup delays
+func (start *CliStart) StartupJitterDelay() time.Duration {
+	return start.startupJitter()
+}
+
+// LimitAttributes lets tests see NewRelic's attribute limits enforced without
+// a NewRelic app
+var LimitAttributes = limitAttributes
+
+// LinkingByAttribute wraps txn so it links traces with an attribute, like the
+// NewRelic backend does
+func LinkingByAttribute(txn Transaction) Transaction {
+	return &attributeLinkingTxn{txn}
+}
+
+type attributeLinkingTxn struct {
+	Transaction
+}
+
+func (txn *attributeLinkingTxn) linkAttribute() string { return "linked_trace_id" }
+
+// GitHubTransport is the transport underneath the GitHub client
+var GitHubTransport = githubTransport
+
+// SetSignalGrace sets how long MainUntilSignaled waits after a signal, until
+// restore is called
+func SetSignalGrace(grace time.Duration) (restore func()) {
+	original := signalGrace
+	signalGrace = grace
+	return func() {
+		signalGrace = original
+	}
+}
@@ -1,16 +1,31 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	mathrand "math/rand"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
 	"path/filepath"
-	"runtime"
+	"reflect"
+	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"text/template"
 	"time"
 
 	"github.com/MakeNowJust/heredoc/v2"
@@ -21,6 +36,7 @@ import (
 	"github.com/newrelic/go-agent/v3/integrations/nrlogrus"
 	"github.com/newrelic/go-agent/v3/newrelic"
 	"github.com/sirupsen/logrus"
+	"gopkg.in/yaml.v3"
 
 	"github.com/shakefu/gha-debug/pkg/fileflag"
 )
@@ -31,28 +47,197 @@ import (
 
 // Cli declares our Kong CLI options so we can extend the type with a few helper functions
 type Cli struct {
-	Debug bool `short:"d" help:"Debug mode."`
+	Debug   bool   `short:"d" help:"Debug mode. Without this or --quiet, GHA_DEBUG_LOG sets the log level (debug, info, warn, error)."`
+	Quiet   bool   `short:"q" help:"Only log warnings and errors. Debug mode takes precedence."`
+	LogFile string `type:"path" placeholder:"PATH" help:"Also write log output to this file."`
+	// Config file values are overridden by environment variables, which are
+	// overridden by flags
+	Config kong.ConfigFlag `short:"c" type:"path" placeholder:"PATH" help:"YAML or JSON file of option values, keyed by flag name."`
 
 	Start CliStart `cmd:"" help:"Start the process and open a new transaction." default:"withargs"`
+	Arm   CliArm   `cmd:"" help:"Create the flag file, starting the transaction for a start command run with --no-create-flag."`
 	Stop  CliStop  `cmd:"" help:"Stop a currently waiting transaction and send data to NewRelic, exiting the process."`
+	Env   CliEnv   `cmd:"" help:"Print the GitHub environment variables this tool reads, as JSON."`
+	// FlagPath is so wrapping scripts don't reimplement resolving --flag
+	FlagPath CliFlagPath `cmd:"" help:"Print the resolved flag file path, for scripts which create or remove it themselves."`
+	Check    CliCheck    `cmd:"" help:"Check the start command's configuration works, without starting a transaction."`
+	Watch    CliWatch    `cmd:"" help:"Print each stage of the flag file's lifecycle as it happens, without recording anything."`
 
 	// More options
-	Flag string `short:"f" type:"path" default:"./gha-debug.flag" help:"Flag file to watch for starting and stopping the transaction."`
+	// Flag is resolved by our flagpath mapper rather than the path type, since
+	// relative paths are relative to the workspace when we have one
+	Flag string `short:"f" type:"flagpath" default:"./gha-debug.flag" help:"Flag file to watch for starting and stopping the transaction. Relative paths are relative to GITHUB_WORKSPACE when it's set."`
 
 	// Kong context object
 	ctx *kong.Context `kong:"-"`
+	// Opened LogFile, closed by CloseLogging
+	logFile *os.File `kong:"-"`
 }
 
 // Parse returns a new Cli instance from passed arguments
 func (cli *Cli) Parse() {
-	cli.ctx = kong.Parse(cli,
+	cli.ctx = kong.Parse(cli, cli.options()...)
+}
+
+// ParseArgs parses args like Parse, but returns errors instead of exiting
+func (cli *Cli) ParseArgs(args []string) (err error) {
+	parser, err := kong.New(cli, cli.options()...)
+	if err != nil {
+		return
+	}
+	cli.ctx, err = parser.Parse(args)
+	return
+}
+
+// options returns our Kong configuration
+func (cli *Cli) options() []kong.Option {
+	return []kong.Option{
 		kong.Name("gha-debug"),
 		kong.Description("A GitHub Actions debug tool."),
 		kong.UsageOnError(),
 		kong.ConfigureHelp(kong.HelpOptions{
 			Compact: true,
 			Summary: true,
-		}))
+		}),
+		kong.Configuration(configLoader),
+		kong.NamedMapper("flagpath", kong.MapperFunc(flagPathMapper)),
+	}
+}
+
+// configLoader loads a --config file, using flag names as keys with dashes or
+// underscores, e.g. github_timeout. YAML is a superset of JSON, so every file
+// is read as YAML and handed to Kong's JSON resolver.
+func configLoader(r io.Reader) (kong.Resolver, error) {
+	values := map[string]interface{}{}
+	err := yaml.NewDecoder(r).Decode(&values)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, err
+	}
+	// Kong's JSON resolver only knows underscored keys
+	values, err = underscoreKeys(values)
+	if err != nil {
+		return nil, err
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return nil, err
+	}
+	resolver, err := kong.JSON(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	// Kong prefers resolvers to environment variables, but the environment
+	// is more specific to a run than a shared config file, so it wins
+	var f kong.ResolverFunc = func(context *kong.Context, parent *kong.Path, flag *kong.Flag) (interface{}, error) {
+		for _, env := range flag.Tag.Envs {
+			if os.Getenv(env) != "" {
+				return nil, nil
+			}
+		}
+		return resolver.Resolve(context, parent, flag)
+	}
+	return f, nil
+}
+
+// underscoreKeys returns values with dashes in its keys replaced by
+// underscores, including in nested maps. It's an error for a key to be given
+// both ways, since which one won would be arbitrary.
+func underscoreKeys(values map[string]interface{}) (map[string]interface{}, error) {
+	converted := make(map[string]interface{}, len(values))
+	for key, value := range values {
+		if nested, ok := value.(map[string]interface{}); ok {
+			var err error
+			value, err = underscoreKeys(nested)
+			if err != nil {
+				return nil, err
+			}
+		}
+		name := strings.ReplaceAll(key, "-", "_")
+		if _, ok := converted[name]; ok {
+			return nil, fmt.Errorf("config key %q is given more than once, with dashes and underscores", name)
+		}
+		converted[name] = value
+	}
+	return converted, nil
+}
+
+// flagPathMapper decodes our Flag with ResolveFlagPath, so every command agrees
+// on it regardless of its working directory. Kong applies the decoded values
+// again before running a command, so resolving in a hook like AfterApply would
+// be undone for an explicit --flag.
+func flagPathMapper(ctx *kong.DecodeContext, target reflect.Value) error {
+	var path string
+	err := ctx.Scan.PopValueInto("file", &path)
+	if err != nil {
+		return err
+	}
+	target.SetString(ResolveFlagPath(path))
+	return nil
+}
+
+// ResolveFlagPath returns the absolute path for the flag file at path. Relative
+// paths are resolved against GITHUB_WORKSPACE if it's set, otherwise against
+// the working directory.
+func ResolveFlagPath(path string) string {
+	workspace := os.Getenv("GITHUB_WORKSPACE")
+	if workspace != "" && !filepath.IsAbs(path) && !strings.HasPrefix(path, "~/") {
+		path = filepath.Join(workspace, path)
+	}
+	return kong.ExpandPath(path)
+}
+
+// SetupLogging sets the log level and output from our options
+func (cli *Cli) SetupLogging() (err error) {
+	if cli.LogFile != "" {
+		// Ensure the directory exists
+		err = os.MkdirAll(filepath.Dir(cli.LogFile), 0755)
+		if err != nil {
+			return
+		}
+		cli.logFile, err = os.OpenFile(cli.LogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return
+		}
+		log.SetOutput(io.MultiWriter(os.Stderr, cli.logFile))
+	}
+
+	// Flags win over the environment, so a workflow can still turn on debug
+	if cli.Debug {
+		log.SetLevel(log.DebugLevel)
+		log.Debug("Debug output enabled")
+	} else if cli.Quiet {
+		log.SetLevel(log.WarnLevel)
+	} else if name := os.Getenv("GHA_DEBUG_LOG"); name != "" {
+		level, ok := logLevels[strings.ToLower(strings.TrimSpace(name))]
+		if !ok {
+			err = fmt.Errorf("invalid GHA_DEBUG_LOG %q: must be one of debug, info, warn, error", name)
+			return
+		}
+		log.SetLevel(level)
+		log.Debug("Log level set from GHA_DEBUG_LOG", "level", level)
+	}
+	return
+}
+
+// logLevels are the levels GHA_DEBUG_LOG can set
+var logLevels = map[string]log.Level{
+	"debug": log.DebugLevel,
+	"info":  log.InfoLevel,
+	"warn":  log.WarnLevel,
+	"error": log.ErrorLevel,
+}
+
+// CloseLogging flushes and closes the LogFile, if we opened one, and logs to
+// stderr alone after that
+func (cli *Cli) CloseLogging() {
+	if cli.logFile == nil {
+		return
+	}
+	log.SetOutput(os.Stderr)
+	cli.logFile.Sync()
+	cli.logFile.Close()
+	cli.logFile = nil
 }
 
 // Main runs the command specified
@@ -62,6 +247,44 @@ func (cli *Cli) Main() error {
 	return cli.ctx.Run(cli)
 }
 
+// signalGrace is how long a command has to finish by itself after a signal,
+// e.g. by cutting a backend shutdown short, before MainUntilSignaled gives up
+// on it
+var signalGrace = 2 * time.Second
+
+// MainUntilSignaled runs Main, but returns early if one of signals arrives and
+// the command doesn't finish within signalGrace, with an ExitError for the
+// signal. Either way it returns, rather than the signal killing us, so the log
+// file can still be closed.
+func (cli *Cli) MainUntilSignaled(signals <-chan os.Signal) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- cli.Main()
+	}()
+
+	var sig os.Signal
+	select {
+	case err := <-done:
+		return err
+	case sig = <-signals:
+	}
+	log.Warn("Interrupted, waiting for the command to finish", "signal", sig, "grace", signalGrace)
+	timer := time.NewTimer(signalGrace)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+	}
+
+	// Exit like the signal would have killed us
+	code := ExitFailure
+	if signum, ok := sig.(syscall.Signal); ok {
+		code = 128 + int(signum)
+	}
+	return &ExitError{Code: code, Err: fmt.Errorf("interrupted by %s", sig)}
+}
+
 /**
 // Run in theory will run after command specific Run calls are made, but that's
 // not useful for us here.
@@ -92,14 +315,116 @@ type CliStart struct {
 	Workflow string `short:"w" type:"string" required:"" env:"GITHUB_WORKFLOW" placeholder:"WORKFLOW" help:"GitHub workflow."`
 	Job      string `short:"j" type:"string" required:"" env:"GITHUB_JOB" placeholder:"JOB" help:"GitHub job ID."`
 	Branch   string `short:"b" type:"string" required:"" env:"GITHUB_HEAD_REF" placeholder:"BRANCH" help:"GitHub branch."`
+	JobID    int64  `placeholder:"ID" help:"GitHub job ID, to look up the job directly instead of by runner name."`
+	// RunnerName falls back to RUNNER_NAME in RunnerNameOrEnv, rather than
+	// with an env tag, so it also works for a CliStart we built ourselves
+	RunnerName string `placeholder:"NAME" help:"Runner name for finding our job, instead of RUNNER_NAME."`
+	// JobName is for non-ephemeral runners, where the runner name doesn't
+	// find our job. Matrix jobs are named like "build (ubuntu)"
+	JobName      string `placeholder:"NAME" help:"Job display name for finding our job when no job matches the runner name."`
+	JobNameMatch string `enum:"exact,prefix" default:"exact" help:"How --job-name is matched against job names (${enum}). A prefix matching more than one job doesn't match."`
+
+	// GitHub API options
+	GitHubTimeout time.Duration `name:"github-timeout" default:"30s" placeholder:"DURATION" help:"Timeout for GitHub API calls."`
+	// RunConclusion costs another API call, and the run usually hasn't
+	// concluded yet while our job is part of it
+	RunConclusion bool `help:"Also record the workflow run's conclusion as run_conclusion, when the run has one, with an extra GitHub API call."`
+	// JobFilter trades finding our job even once the run has been re-run, with
+	// all, for never matching a stale job from an earlier attempt, with latest
+	JobFilter string `enum:"all,latest" default:"all" help:"Which of the run's jobs to search for ours when GITHUB_RUN_ATTEMPT isn't set (${enum}). Use latest to avoid matching jobs from earlier attempts of a re-run, at the risk of missing ours if a newer attempt has already started."`
 
 	// Required secrets for talking to GH and NR Apis
 	// TODO: There's a bug where if these have defaults they try to read the file, even if this command is not being used...
 	// Need to file an issue about that and get it fixed
-	NewRelicSecret       kong.NamedFileContentFlag `short:"n" type:"namedfilecontent" help:"Path to New Relic License Key secret."`
-	GHAppIDSecret        kong.NamedFileContentFlag `short:"a" type:"namedfilecontent" help:"Path to GitHub App ID secret."`
-	GHAppInstallIDSecret kong.NamedFileContentFlag `short:"i" type:"namedfilecontent" help:"Path to GitHub App Installation ID secret."`
-	GHAppPrivateKey      string                    `short:"k" type:"existingfile" help:"Path to GitHub App Private Key secret."`
+	// Each falls back to an environment variable when the path isn't given
+	NewRelicSecret       kong.NamedFileContentFlag `short:"n" type:"namedfilecontent" help:"Path to New Relic License Key secret, or set NEW_RELIC_LICENSE_KEY."`
+	GHAppIDSecret        kong.NamedFileContentFlag `short:"a" type:"namedfilecontent" help:"Path to GitHub App ID secret, or set GH_APP_ID."`
+	GHAppInstallIDSecret kong.NamedFileContentFlag `short:"i" type:"namedfilecontent" help:"Path to GitHub App Installation ID secret, or set GH_APP_INSTALLATION_ID. Looked up from the repository if not given."`
+	GHAppPrivateKey      string                    `short:"k" type:"existingfile" help:"Path to GitHub App Private Key secret, or set GH_APP_PRIVATE_KEY."`
+
+	// Transaction options
+	TxnName    string `default:"{{.Workflow}} / {{.Job}}" placeholder:"TEMPLATE" help:"Go template for the transaction name, with the fields .Workflow, .Job, .Branch and .Repo."`
+	StatusAttr string `default:"status" placeholder:"NAME" help:"Attribute name for the job status."`
+	AttrPrefix string `placeholder:"PREFIX" help:"Prefix for every attribute name, to fit existing naming conventions."`
+
+	// Grouping options
+	// Label groups runs of the same workflow across repos, which otherwise
+	// each get their own NewRelic application named for the repo
+	Label        string `placeholder:"LABEL" help:"Label attribute for grouping transactions across runs and repos."`
+	LabelAppName bool   `help:"Use --label as the NewRelic application name instead of the repo, so every repo using the label reports to one application. The repo is still recorded as an attribute, but NewRelic's per-application views and alerts will no longer be per repo."`
+
+	// Custom attributes
+	Attr     map[string]string `placeholder:"KEY=VALUE" help:"Extra attribute to add to the transaction. Can be repeated, and overrides --attr-file."`
+	AttrFile string            `type:"existingfile" placeholder:"PATH" help:"JSON file of an object of string values, each added as an attribute."`
+
+	// Correlation options
+	CorrelationID string `placeholder:"ID" help:"ID for joining this run's data with other systems. A UUID is generated by default."`
+	LinkTrace     string `placeholder:"TRACE-ID" help:"Trace ID to link our transaction to, for traces started elsewhere. NewRelic records it as an attribute, since it has no span links."`
+
+	// Progress options
+	Heartbeat   time.Duration `placeholder:"DURATION" help:"Log that we're still waiting at this interval. Off by default."`
+	MaxWait     time.Duration `placeholder:"DURATION" help:"Give up waiting for the flag file to be removed after this long, recording the status as max_wait_exceeded. Unlimited by default."`
+	SettleDelay time.Duration `placeholder:"DURATION" help:"Wait this long after the flag file is removed before getting the job status, so GitHub has its final conclusion. Off by default."`
+	AutoStop    time.Duration `placeholder:"DURATION" help:"Remove the flag file this long after the transaction starts, like running stop, for time-boxed debug sessions. Off by default."`
+	PollJob     time.Duration `placeholder:"DURATION" help:"Check the job's status from GitHub at this interval while waiting, and stop once it's completed even if the flag file is still there, for when the stop step never runs because the job was cancelled. Off by default."`
+	Summary     bool          `default:"true" negatable:"" help:"Print a summary of the run to stdout when it's done, unless --quiet."`
+	// SummaryFormat json is for pipelines reading stdout, with the same fields
+	// as --result-file
+	SummaryFormat string `enum:"text,json" default:"text" help:"Format of the summary (${enum}). JSON is a single line object with the same fields as --result-file."`
+
+	// Result options
+	ResultFile  string `type:"path" placeholder:"PATH" help:"Write the result of the run to this file as JSON, for later steps to read."`
+	MetricsFile string `type:"path" placeholder:"PATH" help:"Write the run's metrics to this file in the OpenMetrics text format, for a node exporter textfile collector."`
+
+	// Exit options
+	FailOnStatus bool          `help:"Exit non-zero when the job failed, was cancelled or timed out, after the data is sent."`
+	Linger       time.Duration `placeholder:"DURATION" help:"Keep running this long after the data is sent and the summary printed, for runners which end the step as soon as we exit and lose the last of our logs. Off by default."`
+
+	// Safety options
+	AllowExisting bool          `help:"Allow starting when the flag file belongs to another running process."`
+	ResetFlag     bool          `help:"Remove an existing flag file on start instead of resuming it, so each run starts a clean cycle."`
+	FlagContent   string        `env:"GITHUB_RUN_ID" placeholder:"TOKEN" help:"Token written to the flag file, which must be present for it to count as ours. Defaults to the run ID."`
+	StaleAfter    time.Duration `placeholder:"DURATION" help:"Stop waiting if the flag file isn't touched for this long, so abandoned sessions end. Off by default."`
+	PollOnly      bool          `help:"Only poll the flag file instead of watching for file events, for overlay or FUSE filesystems where events are unreliable."`
+
+	// NoTouch is for orchestrators which own the flag file. They create it to
+	// start the transaction and remove it to end it, and we only watch
+	NoTouch bool `help:"Never create or remove the flag file, only watch for it to be created and removed by something else. Its content isn't checked for our token, and it's left alone when we give up waiting. Can't be used with --reset-flag, --listen or --auto-stop."`
+
+	NoCreateFlag bool `help:"Don't create the flag file, and wait for the arm command to create it before starting the transaction. The flag file is still checked and cleaned up as usual."`
+
+	StartupJitter time.Duration `placeholder:"DURATION" help:"Wait a random time up to this long before watching the flag file, so large matrices sharing a flag directory don't all register watches at once. At most 1m. Off by default."`
+
+	WatchExistingDirCreate bool `help:"When the flag file's directory doesn't exist yet, watch its nearest existing parent until it's created, instead of failing."`
+
+	// Hook options
+	OnStart string `placeholder:"COMMAND" help:"Shell command to run once the flag file is created and the transaction starts, e.g. to print connection info. Its output is logged."`
+	OnStop  string `placeholder:"COMMAND" help:"Shell command to run once the flag file is removed. Its output is logged."`
+
+	// Control options
+	Listen string `placeholder:"ADDR" help:"Listen on this address for POST /stop, which stops like removing the flag file, for when stop can't reach the flag file."`
+
+	// Where to send our data
+	Backend string `default:"newrelic" help:"Backend to record data to (newrelic, stdout), or a comma separated list of them to record to each."`
+	Output  string `type:"path" placeholder:"PATH" help:"File to append records to for the stdout backend, instead of stdout."`
+
+	// Backend connection options
+	ConnectTimeout    time.Duration `default:"30s" placeholder:"DURATION" help:"How long to wait for the backend to connect."`
+	RequireConnection bool          `help:"Exit with an error if the backend can't connect, instead of running without recording."`
+
+	// ConfigDump shows what flags, env and defaults resolved to, where the
+	// env command only shows the raw environment
+	ConfigDump bool `help:"Print the resolved configuration as JSON, with secrets redacted, and exit without running."`
+
+	// GitHub client, created on first use
+	client  *github.Client `kong:"-"`
+	actions GitHubActions  `kong:"-"` // actions replaces the client's, if set
+	flag    Flag           `kong:"-"` // flag replaces the flag file's, if set
+	jobURL  string         `kong:"-"` // jobURL is set once we've found our job
+	baseURL string         `kong:"-"` // GitHub API URL, defaults to the public API
+
+	// Our merged custom attributes, set by Run
+	attributes map[string]string `kong:"-"`
 }
 
 // Help returns the help text for the "start" command
@@ -108,13 +433,113 @@ func (start *CliStart) Help() string {
 	This command will start the process and open a new transaction in NewRelic.
 	It will attempt to read the information given by the GitHub Actions Runner
 	process to determine the repository, workflow name, job ID, and branch name.
+
+	Exit codes:
+	  0  success, including when the job failed without --fail-on-status
+	  1  any other error
+	  2  the job failed, was cancelled or timed out, with --fail-on-status
+	  3  we gave up waiting after --max-wait, with --fail-on-status
+	  4  the backend didn't connect, with --require-connection
+	  5  GitHub authentication failed so the job status is unknown, with
+	     --fail-on-status
 	`)
 }
 
+// Validate checks our options once they've been parsed
+func (start *CliStart) Validate() (err error) {
+	_, err = start.TransactionName()
+	if err != nil {
+		return
+	}
+	if start.LinkTrace != "" && !traceIDPattern.MatchString(start.LinkTrace) {
+		err = fmt.Errorf("invalid --link-trace %q: must be 32 lowercase hex characters", start.LinkTrace)
+		return
+	}
+	if start.StartupJitter > maxStartupJitter {
+		err = fmt.Errorf("invalid --startup-jitter %s: must be at most %s", start.StartupJitter, maxStartupJitter)
+		return
+	}
+	if start.NoTouch && (start.ResetFlag || start.Listen != "" || start.AutoStop > 0) {
+		err = errors.New("--no-touch can't be used with --reset-flag, --listen or --auto-stop, which remove the flag file")
+		return
+	}
+	for _, name := range start.Backends() {
+		if !knownBackend(name) {
+			err = fmt.Errorf("invalid --backend %q: must be one of %s", name, strings.Join(backendNames, ", "))
+			return
+		}
+	}
+	return
+}
+
+// knownBackend returns true if name is one of our backendNames
+func knownBackend(name string) bool {
+	for _, known := range backendNames {
+		if name == known {
+			return true
+		}
+	}
+	return false
+}
+
+// traceIDPattern matches a W3C trace ID
+var traceIDPattern = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// TransactionName renders the TxnName template for this job
+func (start *CliStart) TransactionName() (name string, err error) {
+	tmpl, err := template.New("txn-name").Option("missingkey=error").Parse(start.TxnName)
+	if err != nil {
+		err = fmt.Errorf("invalid --txn-name: %w", err)
+		return
+	}
+
+	var buf strings.Builder
+	err = tmpl.Execute(&buf, struct {
+		Workflow string
+		Job      string
+		Branch   string
+		Repo     string
+	}{start.Workflow, start.Job, start.Branch, start.Repo})
+	if err != nil {
+		err = fmt.Errorf("invalid --txn-name: %w", err)
+		return
+	}
+	name = buf.String()
+	return
+}
+
 // Run executes the "start" command
 func (start *CliStart) Run(cli *Cli) (err error) {
 	log.Debug("Start command")
 
+	if start.ConfigDump {
+		config, configErr := start.Config(cli)
+		if configErr != nil {
+			return configErr
+		}
+		fmt.Println(structToJSON(config))
+		return
+	}
+
+	// Always leave a result for later steps, however we finish
+	var summary runSummary
+	if start.ResultFile != "" {
+		defer func() {
+			resultErr := start.writeResult(summary, err)
+			if resultErr != nil {
+				log.Warn("Could not write result file", "filename", start.ResultFile, "err", resultErr)
+			}
+		}()
+	}
+	if start.MetricsFile != "" {
+		defer func() {
+			metricsErr := start.writeMetrics(summary, err)
+			if metricsErr != nil {
+				log.Warn("Could not write metrics file", "filename", start.MetricsFile, "err", metricsErr)
+			}
+		}()
+	}
+
 	/**
 	// Useless over-debugging
 	log.Debug("Repo", "repo", start.Repo)
@@ -131,232 +556,1530 @@ func (start *CliStart) Run(cli *Cli) (err error) {
 	log.Debug("RUNNER_NAME", "env", os.Getenv("RUNNER_NAME")
 	**/
 
-	// Get the NewRelic App instance from our CLI params
-	log.Debug("Creating NewRelic app...")
-	app, err := start.NewRelicApp()
+	// Make sure we have an ID to correlate our data with
+	_, err = start.EnsureCorrelationID()
+	if err != nil {
+		return
+	}
+
+	// Read our custom attributes before anything is waiting on us
+	start.attributes, err = start.CustomAttributes()
 	if err != nil {
-		log.Fatal("Could not create NewRelic app", "err", err)
 		return
 	}
-	log.Debug("Waiting for NewRelic app to connect...")
-	err = app.WaitForConnection(30 * time.Second)
+
+	// An externally managed flag file isn't ours to check or clean up
+	if !start.NoTouch {
+		err = start.prepareFlag(cli.Flag)
+		if err != nil {
+			return
+		}
+	}
+
+	// Get the Backend instance from our CLI params
+	log.Debug("Creating backend...", "backend", start.Backend)
+	backend, err := start.NewBackend()
 	if err != nil {
-		log.Warn("Could not connect to NewRelic app, nothing will be recorded", "err", err)
+		err = fmt.Errorf("could not create backend: %w", err)
+		return
+	}
+	log.Debug("Waiting for backend to connect...")
+	err = backend.WaitForConnection(start.ConnectTimeout)
+	if err != nil && start.RequireConnection {
+		err = &ExitError{Code: ExitConnectTimeout, Err: fmt.Errorf("could not connect to backend: %w", err)}
 		return
+	} else if err != nil {
+		// Carry on, so the job isn't held up by our telemetry, but make it
+		// obvious the data is going nowhere, e.g. from a bad license key
+		log.Warn("Could not connect to backend, its data won't be recorded", "err", err)
+		err = nil
+	} else {
+		log.Debug("Backend connected!")
+	}
+
+	// Spread out many starts sharing a flag directory, before any of them
+	// watches it
+	if start.StartupJitter > 0 {
+		delay := start.startupJitter()
+		log.Debug("Waiting out startup jitter", "delay", delay)
+		sleepUnlessSignaled(delay)
 	}
-	log.Debug("Application connected!")
 
 	// Create a FileFlag semaphore to listen for the flag file
-	flag, err := fileflag.NewFileFlag(cli.Flag)
+	flag, err := start.NewFlag(cli.Flag)
 	if err != nil {
-		log.Fatal("Could not create flag file", "err", err)
+		err = fmt.Errorf("could not watch flag file: %w", err)
 		return
 	}
 	// Ensure we clean up after ourselves to prevent hanging processes
 	defer flag.Close()
 
-	// Start watching for file events
+	// Let the transaction be stopped over HTTP as well as by the flag file.
+	// We listen before anything starts, so a bad address fails straight away
+	if start.Listen != "" {
+		var shutdown func()
+		shutdown, err = startControlServer(start.Listen, flag)
+		if err != nil {
+			err = fmt.Errorf("could not listen for stop requests: %w", err)
+			return
+		}
+		defer shutdown()
+	}
+
+	// Start watching for file events, making sure we're watching before we
+	// create the flag so a leftover file can be told apart from ours
 	go flag.Watch()
-	runtime.Gosched()
+	flag.WaitForWatch()
 
-	// Create the flag file if it doesn't exist
-	err = touchFile(cli.Flag)
-	if err != nil {
-		log.Fatal("Could not create flag file", "err", err)
-		return
+	// Create the flag file if it doesn't exist, marking it as ours, with our
+	// correlation ID so the stop side can reference it too
+	if start.NoTouch || start.NoCreateFlag {
+		log.Info("Waiting for the flag file to be created", "filename", cli.Flag)
+	} else {
+		err = touchFile(cli.Flag, []byte(fmt.Sprintf("%d\n%s\n%s\n", os.Getpid(), start.FlagContent, start.CorrelationID)))
+		if err != nil {
+			err = fmt.Errorf("could not create flag file: %w", err)
+			return
+		}
 	}
 
 	// Wait for the start flag
 	log.Debug("Waiting for watcher start")
 	flag.WaitForStart()
+	runHook("on-start", start.OnStart)
 
 	// Transaction timing
-	start.transaction(app, flag)
+	summary = start.transaction(backend, flag)
+	if summary.Status == maxWaitStatus && !start.NoTouch {
+		// Nobody removed the flag, so clean it up ourselves
+		err = os.Remove(cli.Flag)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Warn("Could not remove flag file", "filename", cli.Flag, "err", err)
+		}
+		err = nil
+	}
+	if start.Summary && !cli.Quiet && !start.writesStdout() {
+		start.printSummary(summary)
+	}
 
-	// Default to 60s timeout sending data to NR
-	log.Debug("Sending data to NewRelic...")
-	app.Shutdown(60 * time.Second)
+	// Default to 60s timeout sending data to the backend, but let a signal cut
+	// that short rather than holding up the process exit
+	log.Debug("Sending data to backend...")
+	shutdownCtx, stopSignals := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	shutdownCtx, cancel := context.WithTimeout(shutdownCtx, 60*time.Second)
+	backend.ShutdownContext(shutdownCtx)
+	cancel()
+	stopSignals()
 
 	log.Debug("Shutdown complete.")
+	start.linger()
+
+	// Reflect the job outcome in our exit code, if we want to
+	if start.FailOnStatus {
+		err = summary.exitError()
+		if err != nil {
+			return
+		}
+	}
 
 	log.Debug("All done.")
 	return
 }
 
-func (start *CliStart) transaction(app *newrelic.Application, flag *fileflag.FileFlag) {
-	// NewRelic transaction name is the workflow name and job name
-	name := fmt.Sprintf("%s / %s", start.Workflow, start.Job)
+// Flag is the part of a FileFlag start uses to follow the flag's lifecycle, so
+// the flag can be driven without a flag file instead.
+type Flag interface {
+	Watch()
+	WaitForWatch()
+	WaitForStart()
+	Wait()
+	WaitContext(ctx context.Context) error
+	Close() error
+	Release() error
+	Resumed() bool
+	StartSource() string
+}
+
+// NewFlag returns the Flag for the flag file at path, configured by our CLI
+// params
+func (start *CliStart) NewFlag(path string) (flag Flag, err error) {
+	if start.flag != nil {
+		flag = start.flag
+		return
+	}
+
+	// Whoever manages the flag file decides what's in it, so it can't carry
+	// our token
+	token := start.FlagContent
+	if start.NoTouch {
+		token = ""
+	}
+	ff, err := fileflag.NewFileFlagWithOptions(path, fileflag.FileFlagOptions{
+		Token:      token,
+		StaleAfter: start.StaleAfter,
+		PollOnly:   start.PollOnly,
+
+		WatchMissingDir: start.WatchExistingDirCreate,
+	})
+	if err != nil {
+		return
+	}
+	flag = ff
+	return
+}
+
+// prepareFlag makes sure the flag file at path is safe for us to create,
+// removing any left over from a previous run which won't be coming back.
+func (start *CliStart) prepareFlag(path string) (err error) {
+	// Make sure we aren't about to fight another process over the flag file
+	err = start.CheckFlag(path)
+	if err != nil {
+		return
+	}
+
+	// A flag file without our token is left over from another run, and would
+	// never count as ours, so replace it unless its owner is still running
+	if start.FlagContent != "" && fileflag.Check(path) && !fileflag.HasToken(path, start.FlagContent) {
+		if _, alive := flagOwnerAlive(path); alive {
+			err = fmt.Errorf("flag file %s belongs to another running process and run", path)
+			return
+		}
+		log.Warn("Removing stale flag file", "filename", path)
+		err = os.Remove(path)
+		if err != nil {
+			return
+		}
+	}
+
+	// Start from a fresh flag file when asked, rather than resuming whatever
+	// a crashed run left behind. A running owner was already checked for.
+	if start.ResetFlag && fileflag.Check(path) {
+		log.Warn("Removing existing flag file", "filename", path)
+		err = os.Remove(path)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		err = nil
+	}
+	return
+}
+
+// Exit codes, so scripts running us can tell why we failed. Only the start
+// command has codes of its own.
+const (
+	ExitFailure        = 1 // ExitFailure is any error without its own code
+	ExitJobFailed      = 2 // ExitJobFailed is a failed job with FailOnStatus
+	ExitMaxWait        = 3 // ExitMaxWait is giving up after MaxWait with FailOnStatus
+	ExitConnectTimeout = 4 // ExitConnectTimeout is the backend not connecting with RequireConnection
+	ExitGitHubAuth     = 5 // ExitGitHubAuth is failing to authenticate with GitHub with FailOnStatus
+)
+
+// ExitError is an error which exits the process with Code
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (e *ExitError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *ExitError) Unwrap() error {
+	return e.Err
+}
+
+// ExitCode returns the exit code for err, which is 0 for no error, and
+// ExitFailure unless err is an ExitError
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+	return ExitFailure
+}
+
+// exitError returns the error to exit with for FailOnStatus, if the run
+// didn't succeed
+func (s runSummary) exitError() error {
+	switch {
+	case s.Status == maxWaitStatus:
+		return &ExitError{Code: ExitMaxWait, Err: errors.New("gave up waiting for the job to finish")}
+	case s.githubAuthFailed:
+		return &ExitError{Code: ExitGitHubAuth, Err: errors.New("could not authenticate with GitHub to get the job status")}
+	case failedStatuses[s.Status]:
+		return &ExitError{Code: ExitJobFailed, Err: fmt.Errorf("job finished with status %s", s.Status)}
+	}
+	return nil
+}
+
+// maxWaitStatus is our status when we gave up waiting after MaxWait
+const maxWaitStatus = "max_wait_exceeded"
+
+// failedStatuses are the job statuses which fail us with FailOnStatus
+var failedStatuses = map[string]bool{
+	"failure":   true,
+	"cancelled": true,
+	"timed_out": true,
+}
+
+func (start *CliStart) transaction(backend Backend, flag Flag) (summary runSummary) {
+	// Transaction name defaults to the workflow name and job name, and was
+	// already validated when parsing
+	name, _ := start.TransactionName()
 
-	// Start a new transaction
-	txn := app.StartTransaction(name)
-	txn.SetName(name)
+	// Start a new transaction, with our attributes renamed if we're asked to
+	txn := start.renameAttributes(backend.StartTransaction(name))
 
 	// End the transaction when this function exits
 	defer txn.End()
 
-	if txn.Name() == "" {
-		log.Warn("No name set on Transaction instance, implying it is misconfigured")
-	}
-	log.Debug("Transaction started", "name", txn.Name())
+	log.Debug("Transaction started", "name", name)
 
 	// Annotate the with attributes
 	txn.AddAttribute("branch", start.Branch)
 	txn.AddAttribute("workflow", start.Workflow)
 	txn.AddAttribute("job", start.Job)
 	txn.AddAttribute("repo", start.Repo)
-	txn.AddAttribute("runner", os.Getenv("RUNNER_NAME"))
+	txn.AddAttribute("runner", start.RunnerNameOrEnv())
 	txn.AddAttribute("actor", os.Getenv("GITHUB_ACTOR"))
 	txn.AddAttribute("triggering_actor", os.Getenv("GITHUB_TRIGGERING_ACTOR"))
-	txn.AddAttribute("run_number", os.Getenv("GITHUB_RUN_NUMBER"))
-	txn.AddAttribute("run_id", os.Getenv("GITHUB_RUN_ID"))
+	txn.AddAttribute("run_number", envNumber("GITHUB_RUN_NUMBER"))
+	txn.AddAttribute("run_id", envNumber("GITHUB_RUN_ID"))
+	txn.AddAttribute("resumed", flag.Resumed())
+	txn.AddAttribute("start_source", flag.StartSource())
+	txn.AddAttribute("correlation_id", start.CorrelationID)
+	txn.AddAttribute("gha_trace_id", start.RunTraceID())
+	if start.Label != "" {
+		txn.AddAttribute("label", start.Label)
+	}
+	// Runner pools are found from the job instead, if they aren't set here
+	if labels := runnerLabels(); labels != "" {
+		txn.AddAttribute("runner_labels", labels)
+	}
+	if group := os.Getenv("RUNNER_GROUP"); group != "" {
+		txn.AddAttribute("runner_group", group)
+	}
+
+	for key, value := range start.attributes {
+		txn.AddAttribute(key, value)
+	}
+
+	// Join the workflow's trace, if whatever is running us is tracing it
+	if traceparent, tracestate := traceContext(); traceparent != "" {
+		log.Debug("Accepting trace context", "traceparent", traceparent)
+		txn.AcceptTraceContext(traceparent, tracestate)
+	}
+	if start.LinkTrace != "" {
+		txn.LinkTrace(start.LinkTrace)
+	}
 
 	// URL format
 	// https://github.com/turo/github-actions-scale-set-deployments/actions/runs/6322221331
-	txn.AddAttribute("run_url", fmt.Sprintf("https://github.com/%s/actions/runs/%s", start.Repo, os.Getenv("GITHUB_RUN_ID")))
+	runURL := fmt.Sprintf("https://github.com/%s/actions/runs/%s", start.Repo, os.Getenv("GITHUB_RUN_ID"))
+	txn.AddAttribute("run_url", runURL)
 
-	// Waiting on our flag to be removed, indicating all the jobs are done
+	// Waiting on our flag to be removed, indicating all the jobs are done, or
+	// until we've waited as long as we're allowed to
 	log.Info("Waiting for action to complete...")
-	flag.Wait()
+	ctx := context.Background()
+	if start.MaxWait > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, start.MaxWait)
+		defer cancel()
+	}
+	waitStart := time.Now()
+	stopHeartbeat := start.StartHeartbeat()
+	stopAutoStop := start.StartAutoStop(flag)
+	waitCtx, jobDone := start.StartJobPoll(ctx, txn)
+	maxed := flag.WaitContext(waitCtx) != nil
+	stopAutoStop()
+	stopHeartbeat()
+	waited := time.Since(waitStart)
+	if jobDone() {
+		// The stop step isn't going to run, so clean up after it, unless the
+		// flag file is managed for us
+		log.Info("Job completed before the flag file was removed")
+		maxed = false
+		if !start.NoTouch {
+			if err := flag.Release(); err != nil {
+				log.Warn("Could not remove flag file", "err", err)
+			}
+		}
+	}
+	if !maxed {
+		runHook("on-stop", start.OnStop)
+	}
 
-	// Get the Job status
-	status, err := start.GitHubJobStatus()
+	// Get the Job status, unless we gave up waiting for the job
+	var status string
+	var err error
+	if maxed {
+		log.Warn("Gave up waiting for action to complete", "maxWait", start.MaxWait)
+		status = maxWaitStatus
+	} else {
+		start.settle()
+		status, err = start.GitHubJobStatus(txn)
+		if start.RunConclusion {
+			start.recordRunConclusion(txn)
+		}
+	}
 	txn.AddAttribute("status", status)
+	txn.AddAttribute("wait_seconds", waited.Seconds())
 	if err != nil {
 		log.Warn("Could not get Job status", "err", err)
 	}
 
 	log.Info("Transaction ended.")
+	return runSummary{
+		Workflow: start.Workflow,
+		Job:      start.Job,
+		Status:   status,
+		Waited:   waited,
+		RunURL:   runURL,
+		JobURL:   start.jobURL,
+
+		githubAuthFailed: isGitHubAuthError(err),
+	}
 }
 
-// structToJSON is a helper for pretty printing structs (mostly used for GH API responses/objects)
-func structToJSON(data interface{}) (out string) {
-	j, _ := json.MarshalIndent(data, "", "  ")
-	out = string(j)
+// CustomAttributes returns the attributes from AttrFile merged with Attr, with
+// Attr winning when both have a key.
+func (start *CliStart) CustomAttributes() (attributes map[string]string, err error) {
+	attributes = map[string]string{}
+	if start.AttrFile != "" {
+		var data []byte
+		data, err = os.ReadFile(start.AttrFile)
+		if err != nil {
+			return
+		}
+		err = json.Unmarshal(data, &attributes)
+		if err != nil {
+			err = fmt.Errorf("invalid --attr-file %s, expected a JSON object of strings: %w", start.AttrFile, err)
+			return
+		}
+	}
+	for key, value := range start.Attr {
+		attributes[key] = value
+	}
+	if _, ok := attributes[""]; ok {
+		err = errors.New("attribute names can't be empty")
+	}
 	return
 }
 
-// touchFile is a helper to create an empty file at the given path for use as a flag file
-func touchFile(path string) (err error) {
-	// Ensure the directory exists
-	err = os.MkdirAll(filepath.Dir(path), 0755)
-	if err != nil {
+// runHook runs command with the shell, if there is one, logging its output. A
+// failing hook is only a warning, and a signal cancels it.
+func runHook(name, command string) {
+	if command == "" {
 		return
 	}
-	// Create the file
-	_, err = os.Stat(path)
-	if err != nil && os.IsNotExist(err) {
-		_, err = os.Create(path)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Debug("Running hook", "hook", name, "command", command)
+	output, err := exec.CommandContext(ctx, "sh", "-c", command).CombinedOutput()
+	if len(output) > 0 {
+		log.Info("Hook output", "hook", name, "output", strings.TrimRight(string(output), "\n"))
+	}
+	if err != nil {
+		log.Warn("Hook failed", "hook", name, "err", err)
 	}
-	return
 }
 
-// GitHubClient returns a GitHub client instance ready to use
-func (start *CliStart) GitHubClient() (client *github.Client, err error) {
-	// Parse int appID out of our byte file content
-	appID, err := strconv.ParseInt(strings.TrimSpace(string(start.GHAppIDSecret.Contents)), 10, 64)
-	if err != nil {
+// settle waits for SettleDelay, unless we're interrupted first
+func (start *CliStart) settle() {
+	if start.SettleDelay <= 0 {
 		return
 	}
+	log.Debug("Waiting for the job status to settle", "delay", start.SettleDelay)
+	if !sleepUnlessSignaled(start.SettleDelay) {
+		log.Warn("Interrupted waiting for the job status to settle")
+	}
+}
 
-	// Parse int appInstID out of our byte file content
-	appInstID, err := strconv.ParseInt(strings.TrimSpace(string(start.GHAppInstallIDSecret.Contents)), 10, 64)
-	if err != nil {
+// linger keeps us running for Linger once we're done, so runners which tear
+// the step down as soon as we exit still capture everything we've logged
+func (start *CliStart) linger() {
+	if start.Linger <= 0 {
 		return
 	}
+	log.Debug("Lingering before exiting", "linger", start.Linger)
+	if !sleepUnlessSignaled(start.Linger) {
+		log.Debug("Interrupted lingering before exiting")
+	}
+}
 
-	appKey := start.GHAppPrivateKey
+// maxStartupJitter bounds StartupJitter, since it holds up the whole job
+const maxStartupJitter = time.Minute
 
-	// Wrap the shared transport for use with the app ID 1 authenticating with
-	// installation ID 99.
-	itr, err := ghinstallation.NewKeyFromFile(
-		http.DefaultTransport,
-		appID,
-		appInstID,
-		appKey,
-	)
+// startupJitter returns a random delay less than StartupJitter
+func (start *CliStart) startupJitter() time.Duration {
+	if start.StartupJitter <= 0 {
+		return 0
+	}
+	return time.Duration(mathrand.Int63n(int64(start.StartupJitter)))
+}
 
-	// Create the GitHub client
-	client = github.NewClient(&http.Client{Transport: itr})
+// sleepUnlessSignaled sleeps for delay, returning false if a signal cut it
+// short
+func sleepUnlessSignaled(delay time.Duration) bool {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// renameAttributes wraps txn to apply StatusAttr and AttrPrefix to its
+// attributes, if they're set.
+func (start *CliStart) renameAttributes(txn Transaction) Transaction {
+	renames := map[string]string{}
+	if start.StatusAttr != "" && start.StatusAttr != "status" {
+		renames["status"] = start.StatusAttr
+	}
+	if start.AttrPrefix == "" && len(renames) == 0 {
+		return txn
+	}
+	return &renamedTransaction{Transaction: txn, prefix: start.AttrPrefix, renames: renames}
+}
+
+// RunTraceID returns an ID derived from the run, so other tools observing the
+// same job compute the same one and can join their data with ours. It's the
+// first 16 bytes of the SHA-256 of "<run ID>:<run attempt>:<job>", from
+// GITHUB_RUN_ID, GITHUB_RUN_ATTEMPT and GITHUB_JOB (or --job), as lowercase
+// hex. Unset values are empty, not left out. This is 32 hex characters like a
+// W3C trace ID, but nothing traces under it.
+func (start *CliStart) RunTraceID() string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{
+		os.Getenv("GITHUB_RUN_ID"),
+		os.Getenv("GITHUB_RUN_ATTEMPT"),
+		start.Job,
+	}, ":")))
+	return hex.EncodeToString(sum[:16])
+}
+
+// traceContext returns the W3C trace context from the environment, which is
+// set as TRACEPARENT or traceparent by tools which trace workflows
+func traceContext() (traceparent, tracestate string) {
+	traceparent = os.Getenv("TRACEPARENT")
+	if traceparent == "" {
+		traceparent = os.Getenv("traceparent")
+	}
+	tracestate = os.Getenv("TRACESTATE")
+	if tracestate == "" {
+		tracestate = os.Getenv("tracestate")
+	}
 	return
 }
 
-// GitHubJobStatus returns the status of the current job from the GitHub API if
-// we can find it.
-func (start *CliStart) GitHubJobStatus() (status string, err error) {
-	// Default status to "unknown"
-	status = "unknown"
+// runSummary is what we print about a run once it's done
+type runSummary struct {
+	Workflow string
+	Job      string
+	Status   string
+	Waited   time.Duration
+	RunURL   string
+	JobURL   string
+
+	// githubAuthFailed is set when the status is unknown because we couldn't
+	// authenticate with GitHub
+	githubAuthFailed bool
+}
 
-	// Use the GitHub client to retrieve run information
-	ghRunID := os.Getenv("GITHUB_RUN_ID")
-	if ghRunID == "" {
-		log.Warn("Could not get GITHUB_RUN_ID")
+func (s runSummary) String() string {
+	return fmt.Sprintf("%s / %s\n  Status:  %s\n  Waited:  %s\n  Run URL: %s\n",
+		s.Workflow, s.Job, s.Status, s.Waited.Round(time.Millisecond), s.RunURL)
+}
+
+// runResult is the JSON written to the ResultFile
+type runResult struct {
+	Status        string  `json:"status"`
+	Waited        float64 `json:"waited"` // Waited is in seconds
+	RunURL        string  `json:"run_url,omitempty"`
+	JobURL        string  `json:"job_url,omitempty"`
+	CorrelationID string  `json:"correlation_id,omitempty"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// printSummary prints the summary to stdout in our SummaryFormat
+func (start *CliStart) printSummary(summary runSummary) {
+	if start.SummaryFormat != "json" {
+		fmt.Fprint(os.Stdout, summary)
 		return
 	}
-
-	// API client wants a 64-bit int
-	runID, err := strconv.ParseInt(ghRunID, 10, 64)
+	data, err := json.Marshal(start.result(summary, nil))
 	if err != nil {
-		log.Warn("Could not parse GITHUB_RUN_ID", "err", err)
-		// TODO: Figure out if we want this to error harder
-		err = nil
+		log.Warn("Could not encode summary", "err", err)
 		return
 	}
+	fmt.Fprintln(os.Stdout, string(data))
+}
 
-	// Split the org and repo name from the repo string, since the API wants
-	// them separate
-	orgName, repoName, found := strings.Cut(start.Repo, "/")
-	if !found {
-		log.Warn("Could not parse GITHUB_REPOSITORY", "repo", start.Repo)
+// writeResult atomically writes the run's result to our ResultFile, so later
+// steps never read a partial file
+func (start *CliStart) writeResult(summary runSummary, runErr error) (err error) {
+	data, err := json.MarshalIndent(start.result(summary, runErr), "", "  ")
+	if err != nil {
 		return
 	}
+	return writeFileAtomic(start.ResultFile, append(data, '\n'))
+}
 
-	// Runner name is unique with Ephemeral runners, so we can use it to find
-	// our job since we don't have the Job ID in our environment
-	runnerName := os.Getenv("RUNNER_NAME")
-	if runnerName == "" {
-		log.Warn("Could not get RUNNER_NAME")
+// result returns the runResult for the summary and whatever error we're
+// finishing with
+func (start *CliStart) result(summary runSummary, runErr error) (result runResult) {
+	result = runResult{
+		Status:        summary.Status,
+		Waited:        summary.Waited.Seconds(),
+		RunURL:        summary.RunURL,
+		JobURL:        summary.JobURL,
+		CorrelationID: start.CorrelationID,
+	}
+	if runErr != nil {
+		result.Error = runErr.Error()
+		// Failing after the job finished keeps its status
+		if result.Status == "" {
+			result.Status = "error"
+		}
+	}
+	return
+}
+
+// writeFileAtomic writes data to a temporary file next to path, then renames
+// it into place, so readers never see a partial file
+func writeFileAtomic(path string, data []byte) (err error) {
+	// Ensure the directory exists
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(dir, filepath.Base(path)+".*")
+	if err != nil {
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return
+	}
+	err = os.Chmod(tmp.Name(), 0644)
+	if err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// writeMetrics atomically writes the run's metrics to our MetricsFile in the
+// OpenMetrics text format, for a node exporter textfile collector to scrape
+func (start *CliStart) writeMetrics(summary runSummary, runErr error) error {
+	status := summary.Status
+	if runErr != nil && status == "" {
+		status = "error"
+	}
+	labels := fmt.Sprintf(`repo="%s",workflow="%s",job="%s",branch="%s",runner="%s"`,
+		escapeLabel(start.Repo), escapeLabel(start.Workflow), escapeLabel(start.Job),
+		escapeLabel(start.Branch), escapeLabel(start.RunnerNameOrEnv()))
+
+	var b strings.Builder
+	fmt.Fprintln(&b, "# HELP gha_debug_wait_seconds How long start waited for the flag file to be removed.")
+	fmt.Fprintln(&b, "# TYPE gha_debug_wait_seconds gauge")
+	fmt.Fprintf(&b, "gha_debug_wait_seconds{%s} %g\n", labels, summary.Waited.Seconds())
+	fmt.Fprintln(&b, "# HELP gha_debug_job_status The job's status, as the status label.")
+	fmt.Fprintln(&b, "# TYPE gha_debug_job_status gauge")
+	fmt.Fprintf(&b, "gha_debug_job_status{%s,status=\"%s\"} 1\n", labels, escapeLabel(status))
+	fmt.Fprintln(&b, "# EOF")
+	return writeFileAtomic(start.MetricsFile, []byte(b.String()))
+}
+
+// labelEscaper escapes OpenMetrics label values
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// escapeLabel returns value escaped for use as an OpenMetrics label value
+func escapeLabel(value string) string {
+	return labelEscaper.Replace(value)
+}
+
+// writesStdout returns true if our backend records to stdout, where a summary
+// would get mixed in with the records
+func (start *CliStart) writesStdout() bool {
+	if start.Output != "" {
+		return false
+	}
+	for _, name := range start.Backends() {
+		if name == "stdout" {
+			return true
+		}
+	}
+	return false
+}
+
+// runnerLabels returns the comma separated RUNNER_LABELS, tidied up, or an
+// empty string if it isn't set
+func runnerLabels() string {
+	var labels []string
+	for _, label := range strings.Split(os.Getenv("RUNNER_LABELS"), ",") {
+		if label = strings.TrimSpace(label); label != "" {
+			labels = append(labels, label)
+		}
+	}
+	return strings.Join(labels, ",")
+}
+
+// envNumber returns the environment variable name as an int64, so backends can
+// aggregate it, or as the string it was if it isn't a number
+func envNumber(name string) interface{} {
+	value := os.Getenv(name)
+	if number, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return number
+	}
+	return value
+}
+
+// RunnerNameOrEnv returns our RunnerName, or RUNNER_NAME if it isn't set
+func (start *CliStart) RunnerNameOrEnv() string {
+	if start.RunnerName != "" {
+		return start.RunnerName
+	}
+	return os.Getenv("RUNNER_NAME")
+}
+
+// EnsureCorrelationID returns our CorrelationID, generating a new UUID for it
+// if it isn't set
+func (start *CliStart) EnsureCorrelationID() (id string, err error) {
+	if start.CorrelationID == "" {
+		start.CorrelationID, err = newUUID()
+	}
+	id = start.CorrelationID
+	return
+}
+
+// newUUID returns a random (version 4) UUID
+func newUUID() (id string, err error) {
+	b := make([]byte, 16)
+	_, err = rand.Read(b)
+	if err != nil {
+		return
+	}
+	// Set the version and variant bits
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	id = fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+	return
+}
+
+// StartHeartbeat logs that we're still waiting every Heartbeat interval, until
+// the returned stop function is called. It does nothing if Heartbeat is unset.
+func (start *CliStart) StartHeartbeat() (stop func()) {
+	if start.Heartbeat <= 0 {
+		return func() {}
+	}
+
+	began := time.Now()
+	ticker := time.NewTicker(start.Heartbeat)
+	done := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		for {
+			select {
+			case <-ticker.C:
+				log.Info("Still waiting", "elapsed", time.Since(began).Round(time.Second))
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	// Stopping waits for the goroutine so nothing is logged afterwards
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			ticker.Stop()
+			close(done)
+			<-finished
+		})
+	}
+}
+
+// StartJobPoll checks whether our job has completed every PollJob, until ctx
+// is done. The returned context is also cancelled once the job has completed,
+// and jobDone stops polling, reporting whether it had.
+func (start *CliStart) StartJobPoll(ctx context.Context, txn Transaction) (waitCtx context.Context, jobDone func() bool) {
+	waitCtx, cancel := context.WithCancel(ctx)
+	if start.PollJob <= 0 {
+		return waitCtx, func() bool {
+			cancel()
+			return false
+		}
+	}
+
+	var completed atomic.Bool
+	stopped := make(chan interface{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(start.PollJob)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-waitCtx.Done():
+				return
+			case <-ticker.C:
+				if start.jobCompleted(txn) {
+					completed.Store(true)
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return waitCtx, func() bool {
+		cancel()
+		<-stopped
+		return completed.Load()
+	}
+}
+
+// StartAutoStop releases flag after AutoStop, removing the flag file just like
+// the stop command, so the wait ends as if the job was done. The returned
+// function cancels it, if it hasn't happened yet.
+func (start *CliStart) StartAutoStop(flag Flag) (stop func()) {
+	if start.AutoStop <= 0 {
+		return func() {}
+	}
+	timer := time.AfterFunc(start.AutoStop, func() {
+		log.Info("Auto-stopping", "after", start.AutoStop)
+		if err := flag.Release(); err != nil {
+			log.Warn("Could not remove flag file", "err", err)
+		}
+	})
+	return func() { timer.Stop() }
+}
+
+// jobCompleted returns whether GitHub reports our job as completed. Failing
+// to find the job is only logged, since we'll try again.
+func (start *CliStart) jobCompleted(txn Transaction) bool {
+	var usage apiUsage
+	job, err := start.findJob(txn, &usage)
+	if err != nil || job == nil {
+		log.Debug("Could not poll Job status", "err", err)
+		return false
+	}
+	log.Debug("Polled Job status", "status", job.GetStatus())
+	return job.GetStatus() == "completed"
+}
+
+// structToJSON is a helper for pretty printing structs (mostly used for GH API responses/objects)
+func structToJSON(data interface{}) (out string) {
+	j, _ := json.MarshalIndent(data, "", "  ")
+	out = string(j)
+	return
+}
+
+// CheckFlag returns an error if the flag file at path was created by another
+// start process which is still running, unless AllowExisting is set.
+func (start *CliStart) CheckFlag(path string) (err error) {
+	pid, alive := flagOwnerAlive(path)
+	if !alive {
+		return
+	}
+
+	if start.AllowExisting {
+		log.Warn("Flag file belongs to another running process", "filename", path, "pid", pid)
+		return
+	}
+	err = fmt.Errorf("flag file %s belongs to another running process (pid %d), use --allow-existing to ignore", path, pid)
+	return
+}
+
+// flagOwnerAlive returns the PID written into the flag file at path, and
+// whether it is another process which is still running
+func flagOwnerAlive(path string) (pid int, alive bool) {
+	pid, ok := flagOwner(path)
+	alive = ok && pid != os.Getpid() && processAlive(pid)
+	return
+}
+
+// flagOwner returns the PID written into the flag file at path, if there is one
+func flagOwner(path string) (pid int, ok bool) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return
+	}
+	// The PID is the first line, followed by our token
+	line, _, _ := strings.Cut(string(content), "\n")
+	pid, err = strconv.Atoi(strings.TrimSpace(line))
+	ok = err == nil && pid > 0
+	return
+}
+
+// processAlive returns true if there is a running process with the given PID
+func processAlive(pid int) bool {
+	process, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	// Signal 0 checks for existence without actually signaling the process
+	err = process.Signal(syscall.Signal(0))
+	return err == nil || errors.Is(err, syscall.EPERM)
+}
+
+// touchFile is a helper to create a file at the given path containing content
+// for use as a flag file. Existing files are left untouched, even when another
+// process creates the file at the same time.
+func touchFile(path string, content []byte) (err error) {
+	// Ensure the directory exists
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return
+	}
+	// Create the file, only if it isn't already there, so we can never
+	// truncate a file someone else just created
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if errors.Is(err, os.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return
+	}
+	_, err = file.Write(content)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		// Don't leave a flag file without its content behind
+		os.Remove(path)
+	}
+	return
+}
+
+// defaultGitHubTimeout is used when GitHubTimeout isn't set
+const defaultGitHubTimeout = 30 * time.Second
+
+// githubContext returns a context for calling the GitHub API, which times out
+// after GitHubTimeout
+func (start *CliStart) githubContext() (context.Context, context.CancelFunc) {
+	timeout := start.GitHubTimeout
+	if timeout <= 0 {
+		timeout = defaultGitHubTimeout
+	}
+	return context.WithTimeout(context.Background(), timeout)
+}
+
+// Config returns our resolved options by field name, for --config-dump. The
+// secrets, including those from the environment, are only shown as set or
+// unset and their length.
+func (start *CliStart) Config(cli *Cli) (config map[string]interface{}, err error) {
+	config = map[string]interface{}{}
+	v := reflect.ValueOf(start).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		value := v.Field(i).Interface()
+		// Durations are easier to check as we'd write them on the command line
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		config[field.Name] = value
+	}
+
+	privateKey, err := start.GitHubAppPrivateKey()
+	if err != nil {
+		return
+	}
+	config["NewRelicSecret"] = redactSecret(start.NewRelicLicenseKey())
+	config["GHAppIDSecret"] = redactSecret(start.GitHubAppID())
+	config["GHAppInstallIDSecret"] = redactSecret(start.GitHubAppInstallationID())
+	config["GHAppPrivateKey"] = redactSecret(string(privateKey))
+
+	config["Flag"], err = filepath.Abs(cli.Flag)
+	return
+}
+
+// redactSecret describes a secret without revealing it
+func redactSecret(secret string) string {
+	if secret == "" {
+		return "unset"
+	}
+	return fmt.Sprintf("set (%d bytes)", len(secret))
+}
+
+// NewRelicLicenseKey returns the NewRelic license key from its secret file,
+// falling back to the NEW_RELIC_LICENSE_KEY environment variable
+func (start *CliStart) NewRelicLicenseKey() string {
+	return secretValue(start.NewRelicSecret, "NEW_RELIC_LICENSE_KEY")
+}
+
+// GitHubAppID returns the GitHub App ID from its secret file, falling back to
+// the GH_APP_ID environment variable
+func (start *CliStart) GitHubAppID() string {
+	return secretValue(start.GHAppIDSecret, "GH_APP_ID")
+}
+
+// GitHubAppInstallationID returns the GitHub App installation ID from its
+// secret file, falling back to the GH_APP_INSTALLATION_ID environment variable
+func (start *CliStart) GitHubAppInstallationID() string {
+	return secretValue(start.GHAppInstallIDSecret, "GH_APP_INSTALLATION_ID")
+}
+
+// GitHubAppPrivateKey returns the GitHub App private key from its secret file,
+// falling back to the GH_APP_PRIVATE_KEY environment variable
+func (start *CliStart) GitHubAppPrivateKey() (key []byte, err error) {
+	if start.GHAppPrivateKey != "" {
+		return os.ReadFile(start.GHAppPrivateKey)
+	}
+	key = []byte(os.Getenv("GH_APP_PRIVATE_KEY"))
+	return
+}
+
+// secretValue returns the secret file's content if the file was given,
+// otherwise the value of the env variable.
+func secretValue(file kong.NamedFileContentFlag, env string) string {
+	if file.Filename != "" {
+		return strings.TrimSpace(string(file.Contents))
+	}
+	return strings.TrimSpace(os.Getenv(env))
+}
+
+// GitHubClient returns a GitHub client instance ready to use
+func (start *CliStart) GitHubClient() (client *github.Client, err error) {
+	// Reuse the client if we've already made one
+	if start.client != nil {
+		client = start.client
+		return
+	}
+
+	// Parse int appID out of our secret
+	appID, err := strconv.ParseInt(start.GitHubAppID(), 10, 64)
+	if err != nil {
+		return
+	}
+
+	appKey, err := start.GitHubAppPrivateKey()
+	if err != nil {
+		return
+	}
+
+	// Wrap the shared transport to authenticate as the app itself, which we
+	// need for looking up installations
+	atr, err := ghinstallation.NewAppsTransport(
+		githubTransport(),
+		appID,
+		appKey,
+	)
+	if err != nil {
+		return
+	}
+	if start.baseURL != "" {
+		atr.BaseURL = start.baseURL
+	}
+
+	// Parse int appInstID out of our secret, or look it up for
+	// this repository if we weren't given one, so one app can serve many orgs
+	var appInstID int64
+	appInstIDContent := start.GitHubAppInstallationID()
+	if appInstIDContent != "" {
+		appInstID, err = strconv.ParseInt(appInstIDContent, 10, 64)
+	} else {
+		appInstID, err = start.GitHubInstallationID(start.newGitHubClient(atr))
+	}
+	if err != nil {
+		return
+	}
+
+	// Wrap the app transport to authenticate as the installation
+	itr := ghinstallation.NewFromAppsTransport(atr, appInstID)
+
+	// Create the GitHub client
+	client = start.newGitHubClient(itr)
+	start.client = client
+	return
+}
+
+// githubTransport returns the transport underneath the GitHub client. In debug
+// mode it logs every request, including the installation token refreshes made
+// by ghinstallation, which has no logging of its own.
+func githubTransport() http.RoundTripper {
+	if log.GetLevel() > log.DebugLevel {
+		return http.DefaultTransport
+	}
+	return &debugTransport{base: http.DefaultTransport}
+}
+
+// debugTransport logs GitHub API requests and responses at debug level. Only
+// the request line and a few response headers are logged, never bodies or
+// other headers, since those carry our tokens.
+type debugTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements http.RoundTripper
+func (t *debugTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	started := time.Now()
+	response, err := t.base.RoundTrip(req)
+	elapsed := time.Since(started)
+	if err != nil {
+		log.Debug("GitHub request failed", "method", req.Method, "url", req.URL.Redacted(), "elapsed", elapsed, "err", err)
+		return response, err
+	}
+
+	log.Debug("GitHub request",
+		"method", req.Method,
+		"url", req.URL.Redacted(),
+		"status", response.StatusCode,
+		"elapsed", elapsed,
+		"request_id", response.Header.Get("X-GitHub-Request-Id"),
+		"rate_limit_remaining", response.Header.Get("X-RateLimit-Remaining"))
+	if strings.HasSuffix(req.URL.Path, "/access_tokens") {
+		if response.StatusCode < http.StatusBadRequest {
+			log.Debug("GitHub installation token refreshed", "url", req.URL.Redacted())
+		} else {
+			log.Debug("GitHub installation token refresh failed", "url", req.URL.Redacted(), "status", response.StatusCode)
+		}
+	}
+	return response, nil
+}
+
+// GitHubActions is the part of the GitHub Actions API we use, so a fake can be
+// used instead of a client
+type GitHubActions interface {
+	GetWorkflowJobByID(ctx context.Context, owner, repo string, jobID int64) (*github.WorkflowJob, *github.Response, error)
+	ListWorkflowJobs(ctx context.Context, owner, repo string, runID int64, opts *github.ListWorkflowJobsOptions) (*github.Jobs, *github.Response, error)
+	ListWorkflowJobsAttempt(ctx context.Context, owner, repo string, runID, attempt int64) (*github.Jobs, *github.Response, error)
+	GetWorkflowRunByID(ctx context.Context, owner, repo string, runID int64) (*github.WorkflowRun, *github.Response, error)
+}
+
+// GitHubActions returns the Actions API from our GitHub client
+func (start *CliStart) GitHubActions() (actions GitHubActions, err error) {
+	if start.actions != nil {
+		actions = start.actions
+		return
+	}
+	client, err := start.GitHubClient()
+	if err != nil {
+		return
+	}
+	actions = &githubActions{client: client}
+	return
+}
+
+// githubActions implements GitHubActions with a GitHub client
+type githubActions struct {
+	client *github.Client
+}
+
+func (a *githubActions) GetWorkflowJobByID(ctx context.Context, owner, repo string, jobID int64) (*github.WorkflowJob, *github.Response, error) {
+	return a.client.Actions.GetWorkflowJobByID(ctx, owner, repo, jobID)
+}
+
+func (a *githubActions) GetWorkflowRunByID(ctx context.Context, owner, repo string, runID int64) (*github.WorkflowRun, *github.Response, error) {
+	return a.client.Actions.GetWorkflowRunByID(ctx, owner, repo, runID)
+}
+
+func (a *githubActions) ListWorkflowJobs(ctx context.Context, owner, repo string, runID int64, opts *github.ListWorkflowJobsOptions) (*github.Jobs, *github.Response, error) {
+	return a.client.Actions.ListWorkflowJobs(ctx, owner, repo, runID, opts)
+}
+
+// ListWorkflowJobsAttempt lists the jobs for a single attempt of a workflow
+// run. go-github doesn't support this endpoint yet, so we call it directly.
+func (a *githubActions) ListWorkflowJobsAttempt(ctx context.Context, owner, repo string, runID, attempt int64) (*github.Jobs, *github.Response, error) {
+	u := fmt.Sprintf("repos/%v/%v/actions/runs/%v/attempts/%v/jobs", owner, repo, runID, attempt)
+	req, err := a.client.NewRequest("GET", u, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	jobs := new(github.Jobs)
+	resp, err := a.client.Do(ctx, req, jobs)
+	if err != nil {
+		return nil, resp, err
+	}
+	return jobs, resp, nil
+}
+
+// GitHubInstallationID looks up the GitHub App installation ID for our
+// repository, using a client authenticated as the app.
+func (start *CliStart) GitHubInstallationID(appClient *github.Client) (id int64, err error) {
+	orgName, repoName, found := strings.Cut(start.Repo, "/")
+	if !found {
+		err = fmt.Errorf("could not parse GITHUB_REPOSITORY %q", start.Repo)
+		return
+	}
+
+	// Context for calling the API with our timeout
+	ctx, cancel := start.githubContext()
+	defer cancel()
+
+	installation, _, err := appClient.Apps.FindRepositoryInstallation(ctx, orgName, repoName)
+	if err != nil {
+		return
+	}
+
+	id = installation.GetID()
+	log.Debug("Found GitHub App installation", "id", id, "repo", start.Repo)
+	return
+}
+
+// newGitHubClient returns a GitHub client using the given transport and our
+// API base URL
+func (start *CliStart) newGitHubClient(transport http.RoundTripper) *github.Client {
+	client := github.NewClient(&http.Client{Transport: transport})
+	if start.baseURL != "" {
+		client.BaseURL, _ = url.Parse(strings.TrimRight(start.baseURL, "/") + "/")
+	}
+	return client
+}
+
+// GitHubJobStatus returns the status of the current job from the GitHub API if
+// we can find it. API calls are timed as segments on txn.
+func (start *CliStart) GitHubJobStatus(txn Transaction) (status string, err error) {
+	// Default status to "unknown"
+	status = "unknown"
+
+	var usage apiUsage
+	job, err := start.findJob(txn, &usage)
+	// Record what it cost us to look up the job, even if we didn't find it
+	txn.AddAttribute("github_api_calls", usage.calls)
+	txn.AddAttribute("github_pages", usage.pages)
+	if usage.requestID != "" {
+		log.Warn("GitHub API request failed", "requestID", usage.requestID, "err", err)
+		txn.AddAttribute("github_request_id", usage.requestID)
+	}
+	if err != nil || job == nil {
+		return
+	}
+
+	// Link straight to the job, when GitHub gives us the link
+	if jobURL := job.GetHTMLURL(); jobURL != "" {
+		txn.AddAttribute("job_url", jobURL)
+		start.jobURL = jobURL
+	}
+
+	// Which runner pool ran the job, when the environment didn't tell us
+	if labels := strings.Join(job.Labels, ","); labels != "" && runnerLabels() == "" {
+		txn.AddAttribute("runner_labels", labels)
+	}
+	if group := job.GetRunnerGroupName(); group != "" && os.Getenv("RUNNER_GROUP") == "" {
+		txn.AddAttribute("runner_group", group)
+	}
+
+	// Steps show when the time went in the job
+	recordSpans(txn, stepSpans(job))
+	recordRunnerWait(txn, job)
+
+	status, failed := jobStatus(job)
+	log.Info("Job status", "status", status)
+
+	// Failures show up in NewRelic's errors, so they can be alerted on
+	if failed != nil {
+		txn.NoticeError(stepError{Step: failed.GetName(), Conclusion: failed.GetConclusion()})
+	}
+	return
+}
+
+// runnerWaitMetric is the custom metric for how long jobs queue waiting for a
+// runner, which autoscaling dashboards chart
+const runnerWaitMetric = "Custom/GHADebug/RunnerWaitSeconds"
+
+// recordRunnerWait records how long the job waited between being queued and a
+// runner starting it, when GitHub gave us both times.
+func recordRunnerWait(txn Transaction, job *github.WorkflowJob) {
+	if job.CreatedAt == nil || job.StartedAt == nil {
+		return
+	}
+	wait := job.StartedAt.Sub(job.CreatedAt.Time)
+	// Clocks can skew, but a job can't start before it's queued
+	if wait < 0 {
+		wait = 0
+	}
+	txn.RecordMetric(runnerWaitMetric, wait.Seconds())
+}
+
+// findJob looks up our job from the GitHub API. The job is nil, without an
+// error, if we don't know enough to find it.
+func (start *CliStart) findJob(txn Transaction, usage *apiUsage) (job *github.WorkflowJob, err error) {
+	// Split the org and repo name from the repo string, since the API wants
+	// them separate
+	orgName, repoName, found := strings.Cut(start.Repo, "/")
+	if !found {
+		log.Warn("Could not parse GITHUB_REPOSITORY", "repo", start.Repo)
+		return
+	}
+
+	// Get the GitHub Actions API from our CLI params
+	actions, err := start.GitHubActions()
+	if err != nil {
+		err = &githubAuthError{err}
+		return
+	}
+
+	// Context for calling the API with our timeout
+	ctx, cancel := start.githubContext()
+	defer cancel()
+
+	// If we were given the job ID we can get it directly, otherwise we have to
+	// go looking for it
+	if start.JobID != 0 {
+		return start.githubJobByID(ctx, txn, actions, orgName, repoName, usage)
+	}
+	return start.githubJobByRunner(ctx, txn, actions, orgName, repoName, usage)
+}
+
+// recordRunConclusion adds the workflow run's conclusion to txn, once GitHub
+// has one. Failing to get it is only a warning, since the job status is what
+// matters most.
+func (start *CliStart) recordRunConclusion(txn Transaction) {
+	conclusion, err := start.GitHubRunConclusion(txn)
+	if err != nil {
+		log.Warn("Could not get workflow run conclusion", "err", err)
+		return
+	}
+	if conclusion == "" {
+		log.Debug("Workflow run has no conclusion yet")
+		return
+	}
+	txn.AddAttribute("run_conclusion", conclusion)
+}
+
+// GitHubRunConclusion returns the conclusion of our whole workflow run from
+// the GitHub API, which is empty until the run has completed. The API call is
+// timed as a segment on txn.
+func (start *CliStart) GitHubRunConclusion(txn Transaction) (conclusion string, err error) {
+	orgName, repoName, found := strings.Cut(start.Repo, "/")
+	if !found {
+		err = fmt.Errorf("could not parse GITHUB_REPOSITORY %q", start.Repo)
+		return
+	}
+	runID, err := strconv.ParseInt(os.Getenv("GITHUB_RUN_ID"), 10, 64)
+	if err != nil {
+		err = fmt.Errorf("could not parse GITHUB_RUN_ID: %w", err)
+		return
+	}
+	actions, err := start.GitHubActions()
+	if err != nil {
+		return
+	}
+
+	ctx, cancel := start.githubContext()
+	defer cancel()
+
+	segment := txn.StartSegment("github.GetWorkflowRunByID")
+	run, response, err := actions.GetWorkflowRunByID(ctx, orgName, repoName, runID)
+	segment.End()
+	if err != nil {
+		return
+	}
+
+	checkRate(response)
+	conclusion = run.GetConclusion()
+	return
+}
+
+// githubAuthError is an error creating an authenticated GitHub client
+type githubAuthError struct {
+	err error
+}
+
+func (e *githubAuthError) Error() string {
+	return fmt.Sprintf("could not create GitHub client: %s", e.err)
+}
+
+func (e *githubAuthError) Unwrap() error {
+	return e.err
+}
+
+// isGitHubAuthError returns whether err is from failing to authenticate with
+// GitHub, either creating the client or by the API refusing our credentials
+func isGitHubAuthError(err error) bool {
+	var authErr *githubAuthError
+	if errors.As(err, &authErr) {
+		return true
+	}
+	var responseErr *github.ErrorResponse
+	return errors.As(err, &responseErr) && responseErr.Response != nil &&
+		responseErr.Response.StatusCode == http.StatusUnauthorized
+}
+
+// apiUsage counts the GitHub API requests made looking up our job, so rate
+// limit usage can be seen per run
+type apiUsage struct {
+	calls     int    // calls is every API request made
+	pages     int    // pages is how many pages of jobs were scanned
+	requestID string // requestID is GitHub's ID for a request which failed
+}
+
+// failed records GitHub's request ID from the response to a failed request,
+// which GitHub support needs to look into it. Not every failure has a
+// response.
+func (usage *apiUsage) failed(response *github.Response) {
+	if response != nil && response.Response != nil {
+		usage.requestID = response.Header.Get("X-GitHub-Request-Id")
+	}
+}
+
+// githubJobByID gets our job using the job ID we were given.
+func (start *CliStart) githubJobByID(ctx context.Context, txn Transaction, actions GitHubActions, orgName, repoName string, usage *apiUsage) (job *github.WorkflowJob, err error) {
+	segment := txn.StartSegment("github.GetWorkflowJobByID")
+	job, response, err := actions.GetWorkflowJobByID(ctx, orgName, repoName, start.JobID)
+	segment.End()
+	usage.calls++
+	if err != nil {
+		usage.failed(response)
 		return
 	}
 
-	// Get the GitHub client instance from our CLI params
-	client, err := start.GitHubClient()
+	checkRate(response)
+	return
+}
+
+// githubJobByRunner finds our job in the workflow run by matching the runner
+// name. The job is nil if it isn't found.
+func (start *CliStart) githubJobByRunner(ctx context.Context, txn Transaction, actions GitHubActions, orgName, repoName string, usage *apiUsage) (job *github.WorkflowJob, err error) {
+	// Use the GitHub client to retrieve run information
+	ghRunID := os.Getenv("GITHUB_RUN_ID")
+	if ghRunID == "" {
+		log.Warn("Could not get GITHUB_RUN_ID")
+		return
+	}
+
+	// API client wants a 64-bit int
+	runID, err := strconv.ParseInt(ghRunID, 10, 64)
 	if err != nil {
-		log.Warn("Could not create GitHub client", "err", err)
+		log.Warn("Could not parse GITHUB_RUN_ID", "err", err)
 		// TODO: Figure out if we want this to error harder
 		err = nil
 		return
 	}
 
-	// Context for calling the API with a timeout of 30s
-	ctx := context.Background()
-	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
-	defer cancel()
+	// Runner name is unique with Ephemeral runners, so we can use it to find
+	// our job since we don't have the Job ID in our environment
+	runnerName := start.RunnerNameOrEnv()
+	if runnerName == "" && start.JobName == "" {
+		log.Warn("Could not get RUNNER_NAME")
+		return
+	}
 
-	// Call the API to get the Jobs associated with the workflow run
-	run, response, err := client.Actions.ListWorkflowJobs(ctx, orgName, repoName, runID, &github.ListWorkflowJobsOptions{Filter: "all"})
+	// Re-runs reuse the run ID, so when we know the attempt we only look at its
+	// jobs to avoid reporting a stale status from an earlier attempt
+	var attempt int64
+	if ghRunAttempt := os.Getenv("GITHUB_RUN_ATTEMPT"); ghRunAttempt != "" {
+		attempt, err = strconv.ParseInt(ghRunAttempt, 10, 64)
+		if err != nil {
+			log.Warn("Could not parse GITHUB_RUN_ATTEMPT", "err", err)
+			attempt = 0
+			err = nil
+		}
+	}
+
+	// Call the API to get the Jobs associated with the workflow run, timing it
+	// so slow API responses are visible in the trace
+	var run *github.Jobs
+	var response *github.Response
+	if attempt > 0 {
+		segment := txn.StartSegment("github.ListWorkflowJobsAttempt")
+		run, response, err = actions.ListWorkflowJobsAttempt(ctx, orgName, repoName, runID, attempt)
+		segment.End()
+	} else {
+		segment := txn.StartSegment("github.ListWorkflowJobs")
+		run, response, err = actions.ListWorkflowJobs(ctx, orgName, repoName, runID, &github.ListWorkflowJobsOptions{Filter: start.jobFilter()})
+		segment.End()
+	}
+	usage.calls++
 	if err != nil {
+		usage.failed(response)
 		return
 	}
+	usage.pages++
 
-	// Sanity check
-	if response.Rate.Remaining < 2 {
-		log.Warn("GitHub API rate limit exceeded", "rate", structToJSON(response.Rate))
-	}
+	checkRate(response)
 
 	// Iterate through all the jobs looking for our runner name, which
-	// identifies this current run uniquely
-	var job *github.WorkflowJob
+	// identifies this current run uniquely. Queued and skipped jobs have no
+	// runner, so they never match
 	for _, item := range run.Jobs {
+		if item.RunnerName == nil || runnerName == "" {
+			continue
+		}
 		if *item.RunnerName == runnerName {
 			job = item
 			break
 		}
 	}
+	if job == nil && start.JobName != "" {
+		job = start.jobByName(run.Jobs)
+	}
 	if job == nil {
-		log.Warn("Could not find Job matching RUNNER_NAME", "runnerName", runnerName)
+		log.Warn("Could not find Job matching RUNNER_NAME", "runnerName", runnerName, "jobName", start.JobName)
+	}
+	return
+}
+
+// jobByName returns the job matching our JobName, or nil if none do. With
+// prefix matching, a prefix which matches more than one job is ambiguous, so
+// it only matches if one of them is an exact match.
+func (start *CliStart) jobByName(jobs []*github.WorkflowJob) (job *github.WorkflowJob) {
+	var matches []*github.WorkflowJob
+	for _, item := range jobs {
+		name := item.GetName()
+		if name == start.JobName {
+			return item
+		}
+		if start.JobNameMatch == "prefix" && strings.HasPrefix(name, start.JobName) {
+			matches = append(matches, item)
+		}
+	}
+	if len(matches) > 1 {
+		log.Warn("Job name prefix matches more than one job", "jobName", start.JobName, "matches", len(matches))
 		return
 	}
+	if len(matches) == 1 {
+		job = matches[0]
+		log.Debug("Found Job by name prefix", "jobName", start.JobName, "name", job.GetName())
+	}
+	return
+}
+
+// jobFilter returns our JobFilter, defaulting to all
+func (start *CliStart) jobFilter() string {
+	if start.JobFilter == "" {
+		return "all"
+	}
+	return start.JobFilter
+}
+
+// stepError describes a failed job step
+type stepError struct {
+	Step       string
+	Conclusion string
+}
 
+func (e stepError) Error() string {
+	return fmt.Sprintf("step %q concluded with %s", e.Step, e.Conclusion)
+}
+
+// ErrorClass groups step failures together in NewRelic
+func (e stepError) ErrorClass() string {
+	return "GitHubStepFailure"
+}
+
+// jobStatus returns the status of the job based on its steps' conclusions,
+// and the step which failed it, if any
+func jobStatus(job *github.WorkflowJob) (status string, failed *github.TaskStep) {
 	// Iterate through all the steps in our job, checking their conclusion
 	status = "success"
 	for _, step := range job.Steps {
@@ -368,6 +2091,7 @@ func (start *CliStart) GitHubJobStatus() (status string, err error) {
 		}
 		if conclusion == "failure" {
 			status = "failure"
+			failed = step
 			// Break out of the loop, since we consider one failure to be the
 			// entire job failing for now
 			// TODO: Figure out if there's a way to detect a failing step that
@@ -376,26 +2100,167 @@ func (start *CliStart) GitHubJobStatus() (status string, err error) {
 			break
 		}
 	}
+	return
+}
 
-	log.Info("Job status", "status", status)
+// stepSpans returns a Span for each of the job's steps which has started,
+// ordered by when they started. Steps which haven't finished, or finished
+// before they started, have no duration rather than a negative one.
+func stepSpans(job *github.WorkflowJob) (spans []Span) {
+	for _, step := range job.Steps {
+		if step.StartedAt == nil {
+			continue
+		}
+		span := Span{Name: step.GetName(), Start: step.StartedAt.Time}
+		if step.CompletedAt != nil && step.CompletedAt.After(span.Start) {
+			span.Duration = step.CompletedAt.Sub(span.Start)
+		}
+		spans = append(spans, span)
+	}
+	sort.SliceStable(spans, func(i, j int) bool {
+		return spans[i].Start.Before(spans[j].Start)
+	})
+	return
+}
+
+// spanWorkers bounds how many spans recordSpans records at once, and is also
+// how many spans it takes before it's worth recording them concurrently
+const spanWorkers = 8
+
+// recordSpans records each span on txn. Jobs with a lot of steps have them
+// recorded by a pool of workers, since backends may do real work per span, so
+// they can be recorded in any order.
+func recordSpans(txn Transaction, spans []Span) {
+	if len(spans) <= spanWorkers {
+		for _, span := range spans {
+			txn.RecordSpan(span)
+		}
+		return
+	}
+
+	queue := make(chan Span)
+	var wg sync.WaitGroup
+	for i := 0; i < spanWorkers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for span := range queue {
+				txn.RecordSpan(span)
+			}
+		}()
+	}
+	for _, span := range spans {
+		queue <- span
+	}
+	close(queue)
+	wg.Wait()
+}
+
+// checkRate warns when we're about to run out of GitHub API requests
+func checkRate(response *github.Response) {
+	// Sanity check, fakes may not give us a response
+	if response != nil && response.Rate.Remaining < 2 {
+		log.Warn("GitHub API rate limit exceeded", "rate", structToJSON(response.Rate))
+	}
+}
+
+// backendNames are the backends which can be given to --backend
+var backendNames = []string{"newrelic", "stdout"}
+
+// Backends returns the names of the backends in our comma separated Backend,
+// defaulting to newrelic
+func (start *CliStart) Backends() (names []string) {
+	for _, name := range strings.Split(start.Backend, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		names = []string{"newrelic"}
+	}
+	return
+}
+
+// NewBackend returns the Backend selected by our CLI params, sending data to
+// all of them if there's more than one. A backend which can't be made is
+// skipped with a warning, so it doesn't stop the others recording; it's only
+// an error if none of them can be made.
+func (start *CliStart) NewBackend() (backend Backend, err error) {
+	var backends []Backend
+	var errs []error
+	for _, name := range start.Backends() {
+		made, newErr := start.newBackend(name)
+		if newErr != nil {
+			log.Warn("Could not create backend, skipping it", "backend", name, "err", newErr)
+			errs = append(errs, fmt.Errorf("backend %q: %w", name, newErr))
+			continue
+		}
+		backends = append(backends, made)
+	}
+	switch len(backends) {
+	case 0:
+		err = errors.Join(errs...)
+	case 1:
+		backend = backends[0]
+	default:
+		backend = NewMultiBackend(backends...)
+	}
+	return
+}
+
+// newBackend returns the named Backend
+func (start *CliStart) newBackend(name string) (backend Backend, err error) {
+	switch name {
+	case "stdout":
+		// Write to stdout unless we were given a file
+		if start.Output == "" {
+			backend = NewWriterBackend(os.Stdout)
+			return
+		}
+		err = os.MkdirAll(filepath.Dir(start.Output), 0755)
+		if err != nil {
+			return
+		}
+		var file *os.File
+		file, err = os.OpenFile(start.Output, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return
+		}
+		backend = &writerBackend{w: file, closer: file}
+	default:
+		var app *newrelic.Application
+		app, err = start.NewRelicApp()
+		if err != nil {
+			return
+		}
+		backend = NewNewRelicBackend(app)
+	}
 	return
 }
 
+// AppName returns the NewRelic application name, which is the repo name
+// unless --label-app-name groups every repo with the same label under it
+func (start *CliStart) AppName() string {
+	name := strings.TrimSpace(start.Repo)
+	if start.LabelAppName && strings.TrimSpace(start.Label) != "" {
+		name = strings.TrimSpace(start.Label)
+	}
+	return fmt.Sprintf("GitHub Actions / %s", name)
+}
+
 // NewRelicApp returns a NewRelic app instance ready to use
 func (start *CliStart) NewRelicApp() (app *newrelic.Application, err error) {
-	// Parse the license key out of our byte file content
-	licenseKey := strings.TrimSpace(string(start.NewRelicSecret.Contents))
-	// Application name is the repo name
-	appName := strings.TrimSpace(start.Repo)
-	appName = fmt.Sprintf("GitHub Actions / %s", appName)
+	licenseKey := start.NewRelicLicenseKey()
+	traceparent, _ := traceContext()
 
 	// Create the NR Application for this transaction
 	app, err = newrelic.NewApplication(
 		newrelic.ConfigLicense(licenseKey),
-		newrelic.ConfigAppName(appName),
+		newrelic.ConfigAppName(start.AppName()),
 		newrelic.ConfigDebugLogger(os.Stdout),
 		newrelic.ConfigInfoLogger(os.Stdout),
-		// newrelic.ConfigDistributedTracerEnabled(true),
+		// Accepting a trace context needs distributed tracing
+		newrelic.ConfigDistributedTracerEnabled(traceparent != ""),
 		func(config *newrelic.Config) {
 			logrus.SetLevel(logrus.DebugLevel)
 			config.Logger = nrlogrus.StandardLogger()
@@ -412,7 +2277,11 @@ func (start *CliStart) NewRelicApp() (app *newrelic.Application, err error) {
  */
 
 // CliStop is the 'stop' subcommand
-type CliStop struct{}
+type CliStop struct {
+	// Glob has to be given explicitly, so a stop never removes more than the
+	// flag file by accident
+	Glob string `placeholder:"PATTERN" help:"Remove every flag file matching this pattern instead of --flag, e.g. to clean up a whole run's flags. Relative patterns are relative to GITHUB_WORKSPACE when it's set. Directories are never removed."`
+}
 
 // Help for the "stop" command
 func (stop *CliStop) Help() string {
@@ -423,37 +2292,402 @@ func (stop *CliStop) Help() string {
 
 // Run executes the "stop" command
 func (stop *CliStop) Run(cli *Cli) (err error) {
+	if stop.Glob != "" {
+		return stop.removeGlob()
+	}
+
 	log.Info("Stopping transaction...")
 	filename := cli.Flag
 	// Check if the path at cli.Flag exists and remove it if it does
-	if _, err = os.Stat(filename); errors.Is(err, os.ErrNotExist) {
-		// file does not exist
+	if !fileflag.Check(filename) {
 		log.Debug("Flag file does not exist, nothing happened")
-	} else if err != nil {
-		log.Error("Error", "err", err)
-	} else {
-		// file exists
-		log.Debug("Flag file exists, cleaning", "filename", filename)
-		err = os.Remove(filename)
+		return
+	}
+	log.Debug("Flag file exists, cleaning", "filename", filename)
+	err = os.Remove(filename)
+	return
+}
+
+// removeGlob removes each flag file matching Glob
+func (stop *CliStop) removeGlob() (err error) {
+	log.Info("Stopping transactions...", "glob", stop.Glob)
+	matches, err := filepath.Glob(ResolveFlagPath(stop.Glob))
+	if err != nil {
+		err = fmt.Errorf("invalid --glob %q: %w", stop.Glob, err)
+		return
+	}
+	if len(matches) == 0 {
+		log.Debug("No flag files matched, nothing happened")
+		return
+	}
+
+	var errs []error
+	for _, filename := range matches {
+		info, statErr := os.Lstat(filename)
+		if statErr != nil {
+			errs = append(errs, statErr)
+			continue
+		}
+		if info.IsDir() {
+			log.Debug("Skipping directory", "filename", filename)
+			continue
+		}
+		if removeErr := os.Remove(filename); removeErr != nil && !errors.Is(removeErr, os.ErrNotExist) {
+			errs = append(errs, removeErr)
+			continue
+		}
+		log.Info("Removed flag file", "filename", filename)
+	}
+	return errors.Join(errs...)
+}
+
+/*
+ * Arm subcommand
+ *
+ * This command creates the flag file for a start command which was run with
+ * --no-create-flag, so announcing we're waiting and starting the transaction
+ * can be separate steps: start watches, arm creates, and stop removes.
+ */
+
+// CliArm is the 'arm' subcommand
+type CliArm struct {
+	FlagContent string `env:"GITHUB_RUN_ID" placeholder:"TOKEN" help:"Token written to the flag file, which must match start's --flag-content. Defaults to the run ID."`
+}
+
+// Help for the "arm" command
+func (arm *CliArm) Help() string {
+	return heredoc.Doc(`
+	This command creates the flag file, with our token in it, for a start
+	command that was run with --no-create-flag. Its transaction starts once the
+	flag file is created, and ends when the stop command removes it. An existing
+	flag file is left as it is.
+	`)
+}
+
+// Run executes the "arm" command
+func (arm *CliArm) Run(cli *Cli) (err error) {
+	log.Info("Arming transaction...")
+	if fileflag.Check(cli.Flag) {
+		log.Debug("Flag file already exists, nothing happened")
+		return
+	}
+	// We won't be around to own the flag file, so the PID line is empty
+	err = touchFile(cli.Flag, []byte(fmt.Sprintf("\n%s\n", arm.FlagContent)))
+	if err != nil {
+		err = fmt.Errorf("could not create flag file: %w", err)
+	}
+	return
+}
+
+/*
+ * Env subcommand
+ *
+ * This is a diagnostic command which prints the GitHub context environment
+ * variables we read, so users can check their runner provides what we expect.
+ */
+
+// githubEnv is every environment variable we consult for the GitHub context
+var githubEnv = []string{
+	"GITHUB_REPOSITORY",
+	"GITHUB_WORKFLOW",
+	"GITHUB_JOB",
+	"GITHUB_HEAD_REF",
+	"GITHUB_RUN_ID",
+	"GITHUB_RUN_ATTEMPT",
+	"GITHUB_RUN_NUMBER",
+	"GITHUB_ACTOR",
+	"GITHUB_TRIGGERING_ACTOR",
+	"GITHUB_WORKSPACE",
+	"RUNNER_NAME",
+	"RUNNER_LABELS",
+	"RUNNER_GROUP",
+}
+
+// CliEnv is the 'env' subcommand
+type CliEnv struct{}
+
+// Help for the "env" command
+func (env *CliEnv) Help() string {
+	return heredoc.Doc(`
+	This command prints the GitHub context environment variables that the start
+	command reads, along with the resolved flag file path. None of these are
+	secrets, so nothing is redacted. Unset variables are printed as empty.
+	`)
+}
+
+// Run executes the "env" command
+func (env *CliEnv) Run(cli *Cli) (err error) {
+	flag, err := filepath.Abs(cli.Flag)
+	if err != nil {
+		return
+	}
+
+	values := map[string]string{}
+	for _, name := range githubEnv {
+		values[name] = os.Getenv(name)
+	}
+
+	fmt.Println(structToJSON(struct {
+		Env  map[string]string `json:"env"`
+		Flag string            `json:"flag"`
+	}{values, flag}))
+	return
+}
+
+/*
+ * Flag path subcommand
+ */
+
+// CliFlagPath is the 'flag-path' subcommand
+type CliFlagPath struct{}
+
+// Help for the "flag-path" command
+func (fp *CliFlagPath) Help() string {
+	return heredoc.Doc(`
+	This command prints the absolute path of the flag file, resolved the same
+	way start and stop resolve --flag: relative to GITHUB_WORKSPACE when it's
+	set, otherwise the working directory, with ~/ expanded.
+	`)
+}
+
+// Run executes the "flag-path" command. Flag is already resolved when it's
+// parsed, so this is exactly the path the other commands use.
+func (fp *CliFlagPath) Run(cli *Cli) (err error) {
+	fmt.Println(cli.Flag)
+	return
+}
+
+/*
+ * Check subcommand
+ *
+ * This is a preflight command which takes the same options as start, and
+ * checks each thing start needs works, printing a report of the results.
+ */
+
+// CliCheck is the 'check' subcommand
+type CliCheck struct {
+	CliStart `embed:""`
+}
+
+// Help for the "check" command
+func (check *CliCheck) Help() string {
+	return heredoc.Doc(`
+	This command checks that the flag file directory is writable and can be
+	watched, that the GitHub App credentials authenticate, and that the backend
+	connects within --connect-timeout. It prints a JSON report with a result
+	for each check, and exits non-zero if any of them failed.
+	`)
+}
+
+// checkResult is the outcome of a single check
+type checkResult struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// Run executes the "check" command
+func (check *CliCheck) Run(cli *Cli) (err error) {
+	checks := []struct {
+		name string
+		run  func() error
+	}{
+		{"flag_dir_writable", func() error { return checkFlagDir(cli.Flag) }},
+		{"flag_watcher", func() error { return check.checkWatcher(cli.Flag) }},
+		{"github", check.checkGitHub},
+		{"backend", check.checkBackend},
+	}
+
+	var results []checkResult
+	failed := 0
+	for _, c := range checks {
+		result := checkResult{Name: c.name, OK: true}
+		if checkErr := c.run(); checkErr != nil {
+			result.OK = false
+			result.Error = checkErr.Error()
+			failed++
+		}
+		log.Debug("Checked", "check", result.Name, "ok", result.OK)
+		results = append(results, result)
+	}
+
+	fmt.Println(structToJSON(struct {
+		OK     bool          `json:"ok"`
+		Checks []checkResult `json:"checks"`
+	}{failed == 0, results}))
+	if failed > 0 {
+		err = fmt.Errorf("%d of %d checks failed", failed, len(checks))
+	}
+	return
+}
+
+// checkFlagDir checks we can create files next to the flag file, creating its
+// directory like start would
+func checkFlagDir(path string) (err error) {
+	dir := filepath.Dir(path)
+	err = os.MkdirAll(dir, 0755)
+	if err != nil {
+		return
+	}
+	file, err := os.CreateTemp(dir, ".gha-debug-check-*")
+	if err != nil {
+		return
+	}
+	file.Close()
+	return os.Remove(file.Name())
+}
+
+// checkWatcher checks we can watch for the flag file the way start would
+func (check *CliCheck) checkWatcher(path string) (err error) {
+	flag, err := fileflag.NewFileFlagWithOptions(path, fileflag.FileFlagOptions{PollOnly: check.PollOnly})
+	if err != nil {
+		return
+	}
+	return flag.Close()
+}
+
+// checkGitHub checks the GitHub App credentials authenticate, with the rate
+// limit endpoint since it's free
+func (check *CliCheck) checkGitHub() (err error) {
+	client, err := check.GitHubClient()
+	if err != nil {
+		return
+	}
+	ctx, cancel := check.githubContext()
+	defer cancel()
+	_, _, err = client.RateLimits(ctx)
+	return
+}
+
+// checkBackend checks the backend connects within ConnectTimeout
+func (check *CliCheck) checkBackend() (err error) {
+	backend, err := check.NewBackend()
+	if err != nil {
+		return
+	}
+	defer backend.Shutdown(time.Second)
+	return backend.WaitForConnection(check.ConnectTimeout)
+}
+
+/*
+ * Watch subcommand
+ *
+ * This is a diagnostic command which follows a flag file through the same
+ * lifecycle start does, printing each stage, so the start and stop handshake
+ * can be checked in an environment without any backend.
+ */
+
+// CliWatch is the 'watch' subcommand
+type CliWatch struct {
+	Token    string `placeholder:"TOKEN" help:"Token which must be in the flag file for it to count, as with start's --flag-content."`
+	PollOnly bool   `help:"Only poll the flag file instead of watching for file events."`
+
+	// Where stages are printed, defaults to stdout
+	out io.Writer `kong:"-"`
+}
+
+// Help for the "watch" command
+func (watch *CliWatch) Help() string {
+	return heredoc.Doc(`
+	This command watches the flag file and prints a timestamped line as it goes
+	through each stage: watching, started when the flag is created, released
+	when it's removed, and done. It exits once the flag is done, or when it's
+	interrupted. The flag file is never created or removed.
+	`)
+}
+
+// Run executes the "watch" command
+func (watch *CliWatch) Run(cli *Cli) (err error) {
+	flag, err := fileflag.NewFileFlagWithOptions(cli.Flag, fileflag.FileFlagOptions{
+		Token:    watch.Token,
+		PollOnly: watch.PollOnly,
+	})
+	if err != nil {
+		err = fmt.Errorf("could not watch flag file: %w", err)
+		return
+	}
+
+	// Stop following the flag when we're interrupted, which closes it
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	go flag.Watch()
+	flag.WaitForWatch()
+	watch.print("watching", cli.Flag)
+
+	if watch.stage(ctx, flag.WaitForStart) {
+		if flag.Resumed() {
+			watch.print("started", "resumed")
+		} else {
+			watch.print("started", "")
+		}
+		if watch.stage(ctx, flag.Wait) {
+			watch.print("released", "")
+		}
+	}
+	if ctx.Err() != nil {
+		watch.print("interrupted", "")
 	}
+
+	// Nothing else finishes a FileFlag
+	err = flag.Close()
+	watch.print("done", "")
 	return
 }
 
+// stage runs wait until it returns, or ctx is done, returning false if ctx
+// finished first
+func (watch *CliWatch) stage(ctx context.Context, wait func()) bool {
+	done := make(chan struct{})
+	go func() {
+		wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// print prints a timestamped stage, with detail if there is any
+func (watch *CliWatch) print(stage, detail string) {
+	out := watch.out
+	if out == nil {
+		out = os.Stdout
+	}
+	line := time.Now().Format(time.RFC3339Nano) + " " + stage
+	if detail != "" {
+		line += " " + detail
+	}
+	fmt.Fprintln(out, line)
+}
+
 // main runs things
 func main() {
 	var cli Cli
 	cli.Parse()
-
-	if cli.Debug {
-		log.SetLevel(log.DebugLevel)
-		log.Debug("Debug output enabled")
+	err := cli.SetupLogging()
+	if err != nil {
+		log.Fatal("Could not set up logging", "err", err)
 	}
 
 	// TODO: Decide if we want to JSON format logs
 	// log.SetFormatter(log.JSONFormatter)
 
-	err := cli.Main()
+	// Signals are ours until the command is done, so the log file is closed
+	// when we're interrupted too
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	err = cli.MainUntilSignaled(signals)
+	signal.Stop(signals)
 	if err != nil {
-		log.Fatal("Error", "err", err)
+		// Log the error before closing the log file, since log.Fatal would
+		// exit without closing it
+		log.Error("Error", "err", err)
+		cli.CloseLogging()
+		os.Exit(ExitCode(err))
 	}
+	cli.CloseLogging()
 }
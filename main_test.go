@@ -1,9 +1,41 @@
 package main_test
 
 import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/MakeNowJust/heredoc/v2"
+	"github.com/alecthomas/kong"
+	"github.com/charmbracelet/log"
+	"github.com/google/go-github/v55/github"
+	"github.com/newrelic/go-agent/v3/newrelic"
 
 	. "github.com/shakefu/gha-debug"
+	"github.com/shakefu/gha-debug/pkg/softlock"
 
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
@@ -14,9 +46,2892 @@ func TestCli(t *testing.T) {
 	RunSpecs(t, "Main Suite")
 }
 
+// fakeTxn records what would have been sent to NewRelic
+type fakeTxn struct {
+	m          sync.Mutex
+	attributes map[string]interface{}
+	segments   []string
+	errors     []error
+	spans      []Span
+	metrics    map[string]float64
+}
+
+func newFakeTxn() *fakeTxn {
+	return &fakeTxn{attributes: map[string]interface{}{}, metrics: map[string]float64{}}
+}
+
+func (txn *fakeTxn) AddAttribute(key string, value interface{}) {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	txn.attributes[key] = value
+}
+
+func (txn *fakeTxn) StartSegment(name string) Segment {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	txn.segments = append(txn.segments, name)
+	return &newrelic.Segment{Name: name}
+}
+
+func (txn *fakeTxn) NoticeError(err error) {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	txn.errors = append(txn.errors, err)
+}
+
+func (txn *fakeTxn) AcceptTraceContext(traceparent, tracestate string) {}
+
+func (txn *fakeTxn) LinkTrace(traceID string) {}
+
+func (txn *fakeTxn) RecordSpan(span Span) {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	txn.spans = append(txn.spans, span)
+}
+
+func (txn *fakeTxn) RecordMetric(name string, value float64) {
+	txn.m.Lock()
+	defer txn.m.Unlock()
+	txn.metrics[name] = value
+}
+
+func (txn *fakeTxn) End() {}
+
+// fakeBackend is a Backend recording to fakeTxns
+type fakeBackend struct {
+	txns       []*fakeTxn
+	connectErr error
+}
+
+func (b *fakeBackend) StartTransaction(name string) Transaction {
+	txn := newFakeTxn()
+	b.txns = append(b.txns, txn)
+	return txn
+}
+
+func (b *fakeBackend) WaitForConnection(timeout time.Duration) error { return b.connectErr }
+func (b *fakeBackend) Shutdown(timeout time.Duration)                {}
+func (b *fakeBackend) ShutdownContext(ctx context.Context) error     { return nil }
+
+// fakeActions is a GitHubActions serving a fixed list of jobs
+type fakeActions struct {
+	jobs  []*github.WorkflowJob
+	run   *github.WorkflowRun
+	err   error
+	calls []string
+	opts  *github.ListWorkflowJobsOptions // opts are the last ListWorkflowJobs options
+}
+
+func (a *fakeActions) GetWorkflowJobByID(ctx context.Context, owner, repo string, jobID int64) (*github.WorkflowJob, *github.Response, error) {
+	a.calls = append(a.calls, "GetWorkflowJobByID")
+	for _, job := range a.jobs {
+		if job.GetID() == jobID {
+			return job, nil, a.err
+		}
+	}
+	return nil, nil, errors.New("not found")
+}
+
+func (a *fakeActions) ListWorkflowJobs(ctx context.Context, owner, repo string, runID int64, opts *github.ListWorkflowJobsOptions) (*github.Jobs, *github.Response, error) {
+	a.calls = append(a.calls, "ListWorkflowJobs")
+	a.opts = opts
+	return &github.Jobs{Jobs: a.jobs}, nil, a.err
+}
+
+func (a *fakeActions) ListWorkflowJobsAttempt(ctx context.Context, owner, repo string, runID, attempt int64) (*github.Jobs, *github.Response, error) {
+	a.calls = append(a.calls, "ListWorkflowJobsAttempt")
+	return &github.Jobs{Jobs: a.jobs}, nil, a.err
+}
+
+// memoryFlag is a Flag which is started and released by calling it, instead
+// of by a flag file
+type memoryFlag struct {
+	lock     *softlock.SoftLock
+	watching chan interface{}
+	once     sync.Once
+}
+
+func newMemoryFlag() *memoryFlag {
+	return &memoryFlag{lock: softlock.NewSoftLock(), watching: make(chan interface{})}
+}
+
+// Start starts the flag, as creating the flag file would
+func (f *memoryFlag) Start() { f.lock.Start() }
+
+// Waiting returns whether anything is waiting for the flag to be released
+func (f *memoryFlag) Waiting() bool { return f.lock.Waiters() > 0 }
+
+func (f *memoryFlag) Watch()         { f.once.Do(func() { close(f.watching) }) }
+func (f *memoryFlag) WaitForWatch()  { <-f.watching }
+func (f *memoryFlag) WaitForStart()  { f.lock.WaitForStart() }
+func (f *memoryFlag) Wait()          { f.lock.BlockingWait() }
+func (f *memoryFlag) Close() error   { f.lock.Close(); return nil }
+func (f *memoryFlag) Release() error { f.lock.Release(); return nil }
+func (f *memoryFlag) Resumed() bool  { return false }
+
+func (f *memoryFlag) StartSource() string { return "memory" }
+
+func (f *memoryFlag) WaitContext(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		f.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (a *fakeActions) GetWorkflowRunByID(ctx context.Context, owner, repo string, runID int64) (*github.WorkflowRun, *github.Response, error) {
+	a.calls = append(a.calls, "GetWorkflowRunByID")
+	if a.run == nil {
+		return nil, nil, errors.New("not found")
+	}
+	return a.run, nil, a.err
+}
+
+// fakeJob returns a job on runnerName with a step for each conclusion
+func fakeJob(id int64, runnerName string, conclusions ...string) *github.WorkflowJob {
+	job := &github.WorkflowJob{ID: github.Int64(id), RunnerName: github.String(runnerName)}
+	for i, conclusion := range conclusions {
+		job.Steps = append(job.Steps, &github.TaskStep{
+			Name:       github.String(fmt.Sprintf("step-%d", i)),
+			Conclusion: github.String(conclusion),
+		})
+	}
+	return job
+}
+
+// largeJob returns a job on runner-1 with n timed steps, which fail at each of
+// the failed step indexes
+func largeJob(n int, failed ...int) *github.WorkflowJob {
+	conclusions := make([]string, n)
+	for i := range conclusions {
+		conclusions[i] = "success"
+	}
+	for _, i := range failed {
+		conclusions[i] = "failure"
+	}
+	job := fakeJob(1, "runner-1", conclusions...)
+	started := time.Now().Add(-time.Hour)
+	for i, step := range job.Steps {
+		step.StartedAt = &github.Timestamp{Time: started.Add(time.Duration(i) * time.Second)}
+		step.CompletedAt = &github.Timestamp{Time: started.Add(time.Duration(i+1) * time.Second)}
+	}
+	return job
+}
+
+// stubGitHub returns a GitHub API server and a client which talks to it
+func stubGitHub(mux *http.ServeMux) (*httptest.Server, *github.Client) {
+	server := httptest.NewServer(mux)
+	client := github.NewClient(nil)
+	client.BaseURL, _ = url.Parse(server.URL + "/")
+	return server, client
+}
+
+// jobsHandler serves a workflow jobs response with a single job
+func jobsHandler(runnerName, conclusion string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-RateLimit-Remaining", "100")
+		fmt.Fprintf(w, `{"total_count": 1, "jobs": [{"id": 1, "runner_name": %q, "steps": [{"name": "build", "conclusion": %q}]}]}`, runnerName, conclusion)
+	}
+}
+
+// writePrivateKey writes a new GitHub App private key to a temporary file
+func writePrivateKey() string {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	Expect(err).ToNot(HaveOccurred())
+	path := filepath.Join(GinkgoT().TempDir(), "private-key.pem")
+	data := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)})
+	Expect(os.WriteFile(path, data, 0600)).To(Succeed())
+	return path
+}
+
+// secretFile returns a secret flag as if it was read from a file
+func secretFile(content string) kong.NamedFileContentFlag {
+	return kong.NamedFileContentFlag{Filename: "secret", Contents: []byte(content)}
+}
+
+// tokenHandler serves an installation access token
+func tokenHandler(token string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		fmt.Fprintf(w, `{"token": %q, "expires_at": "2099-01-01T00:00:00Z"}`, token)
+	}
+}
+
+// startRecord is the stdout backend's record of a run
+type startRecord struct {
+	Name       string                 `json:"name"`
+	Attributes map[string]interface{} `json:"attributes"`
+	Errors     []string               `json:"errors"`
+	Parent     string                 `json:"parent"`
+	Links      []string               `json:"links"`
+}
+
+// runStart runs the start command with the stdout backend, removing the flag
+// once it's created, and returns the recorded transaction
+func runStart(start *CliStart, cli *Cli) (record startRecord, err error) {
+	dir := GinkgoT().TempDir()
+	start.Backend = "stdout"
+	start.Output = filepath.Join(dir, "output.json")
+	if cli.Flag == "" {
+		cli.Flag = filepath.Join(dir, "gha-debug.flag")
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- start.Run(cli)
+	}()
+
+	Eventually(func() error {
+		_, err := os.Stat(cli.Flag)
+		return err
+	}).Should(Succeed())
+	Expect(os.Remove(cli.Flag)).To(Succeed())
+	Eventually(done, 5).Should(Receive(&err))
+
+	data, readErr := os.ReadFile(start.Output)
+	Expect(readErr).ToNot(HaveOccurred())
+	Expect(json.Unmarshal(data, &record)).To(Succeed())
+	return
+}
+
 var _ = Describe("Cli", func() {
 	It("should pass", func() {
 		cli := Cli{}
 		Expect(cli).ToNot(BeNil())
 	})
+
+	Context("ParseArgs", func() {
+		var config string
+
+		BeforeEach(func() {
+			// Start from a clean environment, since empty variables are ignored
+			for _, name := range []string{"GITHUB_REPOSITORY", "GITHUB_WORKFLOW", "GITHUB_JOB", "GITHUB_HEAD_REF", "GITHUB_RUN_ID"} {
+				GinkgoT().Setenv(name, "")
+			}
+
+			config = filepath.Join(GinkgoT().TempDir(), "gha-debug.yaml")
+			Expect(os.WriteFile(config, []byte(heredoc.Doc(`
+				repo: org/repo
+				workflow: CI
+				job: test
+				branch: main
+				backend: stdout
+				github_timeout: 5s
+				heartbeat: 1m
+			`)), 0644)).To(Succeed())
+		})
+
+		It("should load options from a config file", func() {
+			cli := &Cli{}
+			Expect(cli.ParseArgs([]string{"start", "--config", config})).To(Succeed())
+			Expect(cli.Start.Repo).To(Equal("org/repo"))
+			Expect(cli.Start.Workflow).To(Equal("CI"))
+			Expect(cli.Start.Job).To(Equal("test"))
+			Expect(cli.Start.Branch).To(Equal("main"))
+			Expect(cli.Start.Backend).To(Equal("stdout"))
+			Expect(cli.Start.GitHubTimeout).To(Equal(5 * time.Second))
+			Expect(cli.Start.Heartbeat).To(Equal(time.Minute))
+		})
+
+		It("should load options from a JSON config file", func() {
+			Expect(os.WriteFile(config, []byte(`{"repo": "org/json", "workflow": "CI", "job": "test", "branch": "main"}`), 0644)).To(Succeed())
+			cli := &Cli{}
+			Expect(cli.ParseArgs([]string{"start", "--config", config})).To(Succeed())
+			Expect(cli.Start.Repo).To(Equal("org/json"))
+		})
+
+		It("should load options with dashed keys", func() {
+			Expect(os.WriteFile(config, []byte(heredoc.Doc(`
+				repo: org/repo
+				workflow: CI
+				job: test
+				branch: main
+				github-timeout: 7s
+				stale-after: 2m
+			`)), 0644)).To(Succeed())
+			cli := &Cli{}
+			Expect(cli.ParseArgs([]string{"start", "--config", config})).To(Succeed())
+			Expect(cli.Start.GitHubTimeout).To(Equal(7 * time.Second))
+			Expect(cli.Start.StaleAfter).To(Equal(2 * time.Minute))
+		})
+
+		It("should return an error for a key given both ways", func() {
+			Expect(os.WriteFile(config, []byte("github-timeout: 7s\ngithub_timeout: 5s\n"), 0644)).To(Succeed())
+			cli := &Cli{}
+			Expect(cli.ParseArgs([]string{"start", "--config", config})).To(MatchError(ContainSubstring("github_timeout")))
+		})
+
+		It("should prefer flags and env to the config file", func() {
+			GinkgoT().Setenv("GITHUB_WORKFLOW", "Env")
+			cli := &Cli{}
+			Expect(cli.ParseArgs([]string{"start", "--config", config, "--repo", "org/flag"})).To(Succeed())
+			Expect(cli.Start.Repo).To(Equal("org/flag"))
+			Expect(cli.Start.Workflow).To(Equal("Env"))
+			Expect(cli.Start.Job).To(Equal("test"))
+		})
+
+		It("should return an error for a missing config file", func() {
+			cli := &Cli{}
+			Expect(cli.ParseArgs([]string{"start", "--config", config + ".missing"})).ToNot(Succeed())
+		})
+	})
+
+	Context("ResolveFlagPath", func() {
+		It("should resolve relative paths against the workspace", func() {
+			GinkgoT().Setenv("GITHUB_WORKSPACE", "/work/repo")
+			Expect(ResolveFlagPath("./gha-debug.flag")).To(Equal("/work/repo/gha-debug.flag"))
+			Expect(ResolveFlagPath("tmp/gha-debug.flag")).To(Equal("/work/repo/tmp/gha-debug.flag"))
+		})
+
+		It("should leave absolute paths alone", func() {
+			GinkgoT().Setenv("GITHUB_WORKSPACE", "/work/repo")
+			Expect(ResolveFlagPath("/tmp/gha-debug.flag")).To(Equal("/tmp/gha-debug.flag"))
+		})
+
+		It("should resolve against the working directory without a workspace", func() {
+			GinkgoT().Setenv("GITHUB_WORKSPACE", "")
+			wd, err := os.Getwd()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(ResolveFlagPath("gha-debug.flag")).To(Equal(filepath.Join(wd, "gha-debug.flag")))
+		})
+
+		It("should be applied when parsing", func() {
+			GinkgoT().Setenv("GITHUB_WORKSPACE", "/work/repo")
+			cli := &Cli{}
+			Expect(cli.ParseArgs([]string{"stop"})).To(Succeed())
+			Expect(cli.Flag).To(Equal("/work/repo/gha-debug.flag"))
+		})
+
+		Context("when running a command", func() {
+			var workspace string
+			var path string
+
+			BeforeEach(func() {
+				workspace = GinkgoT().TempDir()
+				path = filepath.Join(workspace, "rel.flag")
+				GinkgoT().Setenv("GITHUB_WORKSPACE", workspace)
+				// Run from elsewhere, so the working directory can't be used
+				wd, err := os.Getwd()
+				Expect(err).ToNot(HaveOccurred())
+				Expect(os.Chdir(GinkgoT().TempDir())).To(Succeed())
+				DeferCleanup(os.Chdir, wd)
+			})
+
+			run := func(args ...string) error {
+				cli := &Cli{}
+				Expect(cli.ParseArgs(args)).To(Succeed())
+				return cli.Main()
+			}
+
+			It("should stop the flag in the workspace", func() {
+				Expect(os.WriteFile(path, []byte("\n"), 0644)).To(Succeed())
+				Expect(run("stop", "-f", "rel.flag")).To(Succeed())
+				Expect(path).ToNot(BeAnExistingFile())
+			})
+
+			It("should arm the flag in the workspace", func() {
+				Expect(run("arm", "-f", "rel.flag")).To(Succeed())
+				Expect(path).To(BeAnExistingFile())
+				Expect("rel.flag").ToNot(BeAnExistingFile())
+			})
+		})
+	})
+
+	Context("SetupLogging", func() {
+		var buf *bytes.Buffer
+
+		BeforeEach(func() {
+			buf = &bytes.Buffer{}
+			log.SetOutput(buf)
+			DeferCleanup(func() {
+				log.SetOutput(os.Stderr)
+				log.SetLevel(log.InfoLevel)
+			})
+		})
+
+		It("should suppress info lines when quiet", func() {
+			cli := Cli{Quiet: true}
+			cli.SetupLogging()
+			log.Info("hidden")
+			log.Warn("shown")
+			Expect(buf.String()).ToNot(ContainSubstring("hidden"))
+			Expect(buf.String()).To(ContainSubstring("shown"))
+		})
+
+		It("should prefer debug over quiet", func() {
+			cli := Cli{Quiet: true, Debug: true}
+			cli.SetupLogging()
+			log.Debug("shown")
+			Expect(buf.String()).To(ContainSubstring("shown"))
+		})
+
+		DescribeTable("setting the level from GHA_DEBUG_LOG",
+			func(value string, shown, hidden string) {
+				GinkgoT().Setenv("GHA_DEBUG_LOG", value)
+				cli := Cli{}
+				Expect(cli.SetupLogging()).To(Succeed())
+				log.Debug("debug line")
+				log.Info("info line")
+				log.Warn("warn line")
+				log.Error("error line")
+				Expect(buf.String()).To(ContainSubstring(shown))
+				if hidden != "" {
+					Expect(buf.String()).ToNot(ContainSubstring(hidden))
+				}
+			},
+			Entry("debug", "debug", "debug line", ""),
+			Entry("info", "info", "info line", "debug line"),
+			Entry("warn", "WARN", "warn line", "info line"),
+			Entry("error", "error", "error line", "warn line"),
+		)
+
+		It("should still force debug with --debug", func() {
+			GinkgoT().Setenv("GHA_DEBUG_LOG", "error")
+			cli := Cli{Debug: true}
+			Expect(cli.SetupLogging()).To(Succeed())
+			log.Debug("shown")
+			Expect(buf.String()).To(ContainSubstring("shown"))
+		})
+
+		It("should reject an unknown GHA_DEBUG_LOG", func() {
+			GinkgoT().Setenv("GHA_DEBUG_LOG", "loud")
+			cli := Cli{}
+			Expect(cli.SetupLogging()).To(MatchError(ContainSubstring("invalid GHA_DEBUG_LOG")))
+		})
+
+		It("should also write to the log file", func() {
+			path := filepath.Join(GinkgoT().TempDir(), "logs", "gha-debug.log")
+			cli := Cli{LogFile: path}
+			Expect(cli.SetupLogging()).To(Succeed())
+			log.Info("logged to file")
+			cli.CloseLogging()
+
+			data, err := os.ReadFile(path)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("logged to file"))
+		})
+
+		It("should return an error when the log file can't be opened", func() {
+			cli := Cli{LogFile: GinkgoT().TempDir()}
+			Expect(cli.SetupLogging()).ToNot(Succeed())
+		})
+	})
+
+	Context("MainUntilSignaled", func() {
+		var signals chan os.Signal
+
+		BeforeEach(func() {
+			signals = make(chan os.Signal, 1)
+			DeferCleanup(SetSignalGrace(50 * time.Millisecond))
+		})
+
+		It("should return the command's result", func() {
+			cli := &Cli{}
+			Expect(cli.ParseArgs([]string{"flag-path"})).To(Succeed())
+			captureStdout(func() {
+				Expect(cli.MainUntilSignaled(signals)).To(Succeed())
+			})
+		})
+
+		It("should return when a signal interrupts a waiting start, so logs can be closed", func() {
+			dir := GinkgoT().TempDir()
+			path := filepath.Join(dir, "gha-debug.log")
+			cli := &Cli{}
+			Expect(cli.ParseArgs([]string{"--log-file", path, "start", "-r", "org/repo", "-w", "CI", "-j", "test", "-b", "main",
+				"--backend", "stdout", "--output", filepath.Join(dir, "output.json")})).To(Succeed())
+			Expect(cli.SetupLogging()).To(Succeed())
+			DeferCleanup(log.SetOutput, os.Stderr)
+			// The flag never starts, so start waits for it until it's closed
+			flag := newMemoryFlag()
+			cli.Start.SetFlag(flag)
+			cli.Start.SetGitHubActions(&fakeActions{})
+			DeferCleanup(flag.Close)
+
+			done := make(chan error, 1)
+			go func() {
+				done <- cli.MainUntilSignaled(signals)
+			}()
+			Eventually(flag.Waiting).Should(BeTrue())
+			signals <- syscall.SIGTERM
+
+			var err error
+			Eventually(done, 1).Should(Receive(&err))
+			Expect(ExitCode(err)).To(Equal(128 + int(syscall.SIGTERM)))
+			cli.CloseLogging()
+			data, readErr := os.ReadFile(path)
+			Expect(readErr).ToNot(HaveOccurred())
+			Expect(string(data)).To(ContainSubstring("Interrupted"))
+		})
+	})
 })
+
+var _ = Describe("CliStart", func() {
+	var start *CliStart
+	var txn *fakeTxn
+	var mux *http.ServeMux
+
+	BeforeEach(func() {
+		GinkgoT().Setenv("GITHUB_RUN_ID", "42")
+		GinkgoT().Setenv("RUNNER_NAME", "runner-1")
+		GinkgoT().Setenv("GITHUB_RUN_ATTEMPT", "")
+		GinkgoT().Setenv("GH_APP_INSTALLATION_ID", "")
+
+		txn = newFakeTxn()
+		mux = http.NewServeMux()
+		server, client := stubGitHub(mux)
+		DeferCleanup(server.Close)
+
+		start = &CliStart{Repo: "org/repo"}
+		start.SetGitHubClient(client)
+	})
+
+	Context("GitHubJobStatus with fake actions", func() {
+		var actions *fakeActions
+
+		BeforeEach(func() {
+			actions = &fakeActions{}
+			start.SetGitHubActions(actions)
+		})
+
+		DescribeTable("resolving the status",
+			func(jobs []*github.WorkflowJob, status string) {
+				actions.jobs = jobs
+				Expect(start.GitHubJobStatus(txn)).To(Equal(status))
+				Expect(actions.calls).To(Equal([]string{"ListWorkflowJobs"}))
+			},
+			Entry("a successful job", []*github.WorkflowJob{fakeJob(1, "runner-1", "success", "success")}, "success"),
+			Entry("a failed step", []*github.WorkflowJob{fakeJob(1, "runner-1", "success", "failure")}, "failure"),
+			Entry("another runner's job", []*github.WorkflowJob{fakeJob(1, "runner-2", "success")}, "unknown"),
+			Entry("no jobs", nil, "unknown"),
+			Entry("our job among others",
+				[]*github.WorkflowJob{fakeJob(1, "runner-2", "failure"), fakeJob(2, "runner-1", "success")}, "success"),
+		)
+
+		DescribeTable("filtering the jobs",
+			func(filter, expected string) {
+				start.JobFilter = filter
+				Expect(start.GitHubJobStatus(txn)).To(Equal("unknown"))
+				Expect(actions.opts.Filter).To(Equal(expected))
+			},
+			Entry("by default", "", "all"),
+			Entry("with all", "all", "all"),
+			Entry("with latest", "latest", "latest"),
+		)
+
+		It("should get the run conclusion", func() {
+			actions.run = &github.WorkflowRun{Conclusion: github.String("failure")}
+			Expect(start.GitHubRunConclusion(txn)).To(Equal("failure"))
+			Expect(actions.calls).To(Equal([]string{"GetWorkflowRunByID"}))
+			Expect(txn.segments).To(Equal([]string{"github.GetWorkflowRunByID"}))
+		})
+
+		It("should have no run conclusion while the run is in progress", func() {
+			actions.run = &github.WorkflowRun{Status: github.String("in_progress")}
+			Expect(start.GitHubRunConclusion(txn)).To(BeEmpty())
+		})
+
+		It("should get the job by ID", func() {
+			start.JobID = 2
+			actions.jobs = []*github.WorkflowJob{fakeJob(1, "runner-1", "success"), fakeJob(2, "runner-2", "failure")}
+			Expect(start.GitHubJobStatus(txn)).To(Equal("failure"))
+			Expect(actions.calls).To(Equal([]string{"GetWorkflowJobByID"}))
+		})
+
+		Context("with --job-name", func() {
+			// namedJob returns a job on a long lived runner, which never matches
+			namedJob := func(id int64, name string) *github.WorkflowJob {
+				job := fakeJob(id, "shared-runner", "success")
+				job.Name = github.String(name)
+				job.HTMLURL = github.String(fmt.Sprintf("https://github.com/org/repo/actions/runs/42/job/%d", id))
+				return job
+			}
+
+			// foundJob returns the ID of the job GitHubJobStatus found, or 0
+			foundJob := func() (id int) {
+				txn := newFakeTxn()
+				_, err := start.GitHubJobStatus(txn)
+				Expect(err).ToNot(HaveOccurred())
+				if url, ok := txn.attributes["job_url"].(string); ok {
+					fmt.Sscanf(url, "https://github.com/org/repo/actions/runs/42/job/%d", &id)
+				}
+				return
+			}
+
+			BeforeEach(func() {
+				actions.jobs = []*github.WorkflowJob{
+					namedJob(1, "lint"),
+					namedJob(2, "build (ubuntu)"),
+					namedJob(3, "build (macos)"),
+					namedJob(4, "test (ubuntu)"),
+				}
+			})
+
+			It("should match the name exactly", func() {
+				start.JobName = "build (macos)"
+				Expect(foundJob()).To(Equal(3))
+				start.JobName = "build"
+				Expect(foundJob()).To(BeZero())
+			})
+
+			It("should match a unique prefix", func() {
+				start.JobName = "test"
+				start.JobNameMatch = "prefix"
+				Expect(foundJob()).To(Equal(4))
+			})
+
+			It("should not match an ambiguous prefix", func() {
+				start.JobName = "build"
+				start.JobNameMatch = "prefix"
+				Expect(foundJob()).To(BeZero())
+			})
+
+			It("should prefer an exact match over prefixes", func() {
+				actions.jobs = append(actions.jobs, namedJob(5, "build"))
+				start.JobName = "build"
+				start.JobNameMatch = "prefix"
+				Expect(foundJob()).To(Equal(5))
+			})
+
+			It("should prefer the runner name", func() {
+				job := namedJob(5, "deploy")
+				job.RunnerName = github.String("runner-1")
+				actions.jobs = append(actions.jobs, job)
+				start.JobName = "build (ubuntu)"
+				Expect(foundJob()).To(Equal(5))
+			})
+
+			It("should be used without a runner name", func() {
+				GinkgoT().Setenv("RUNNER_NAME", "")
+				start.JobName = "lint"
+				Expect(foundJob()).To(Equal(1))
+			})
+		})
+
+		It("should skip jobs without a runner name", func() {
+			queued := fakeJob(1, "")
+			queued.RunnerName = nil
+			actions.jobs = []*github.WorkflowJob{queued, fakeJob(2, "runner-1", "failure")}
+			Expect(start.GitHubJobStatus(txn)).To(Equal("failure"))
+		})
+
+		It("should resolve a large job deterministically", func() {
+			actions.jobs = []*github.WorkflowJob{largeJob(500, 300, 400)}
+			for i := 0; i < 10; i++ {
+				txn := newFakeTxn()
+				Expect(start.GitHubJobStatus(txn)).To(Equal("failure"))
+				Expect(txn.spans).To(HaveLen(500))
+				Expect(txn.errors).To(HaveLen(1))
+				Expect(txn.errors[0]).To(MatchError(`step "step-300" concluded with failure`))
+			}
+		})
+
+		Context("runner pool", func() {
+			BeforeEach(func() {
+				GinkgoT().Setenv("RUNNER_LABELS", "")
+				GinkgoT().Setenv("RUNNER_GROUP", "")
+				job := fakeJob(1, "runner-1", "success")
+				job.Labels = []string{"self-hosted", "gpu"}
+				job.RunnerGroupName = github.String("gpu-pool")
+				actions.jobs = []*github.WorkflowJob{job}
+			})
+
+			It("should be resolved from the job", func() {
+				Expect(start.GitHubJobStatus(txn)).To(Equal("success"))
+				Expect(txn.attributes).To(HaveKeyWithValue("runner_labels", "self-hosted,gpu"))
+				Expect(txn.attributes).To(HaveKeyWithValue("runner_group", "gpu-pool"))
+			})
+
+			It("should prefer the environment", func() {
+				GinkgoT().Setenv("RUNNER_LABELS", "linux")
+				GinkgoT().Setenv("RUNNER_GROUP", "default")
+				Expect(start.GitHubJobStatus(txn)).To(Equal("success"))
+				Expect(txn.attributes).ToNot(HaveKey("runner_labels"))
+				Expect(txn.attributes).ToNot(HaveKey("runner_group"))
+			})
+		})
+
+		It("should return API errors", func() {
+			actions.err = errors.New("boom")
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).To(MatchError("boom"))
+			Expect(status).To(Equal("unknown"))
+			// Without a response there's no request ID
+			Expect(txn.attributes).ToNot(HaveKey("github_request_id"))
+		})
+	})
+
+	Context("GitHubJobStatus", func() {
+		It("should record a segment around the API call", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "success"))
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status).To(Equal("success"))
+			Expect(txn.segments).To(Equal([]string{"github.ListWorkflowJobs"}))
+		})
+
+		It("should match the job by --runner-name over RUNNER_NAME", func() {
+			start.RunnerName = "runner-2"
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-2", "success"))
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status).To(Equal("success"))
+		})
+
+		It("should not match the job by RUNNER_NAME when --runner-name is set", func() {
+			start.RunnerName = "runner-2"
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "success"))
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status).To(Equal("unknown"))
+		})
+
+		It("should record how many API calls were made", func() {
+			requests := 0
+			handler := jobsHandler("runner-1", "success")
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				requests++
+				handler(w, r)
+			})
+
+			_, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(requests).To(Equal(1))
+			Expect(txn.attributes).To(HaveKeyWithValue("github_api_calls", requests))
+			Expect(txn.attributes).To(HaveKeyWithValue("github_pages", 1))
+		})
+
+		It("should record API calls for a job looked up by ID", func() {
+			start.JobID = 7
+			mux.HandleFunc("/repos/org/repo/actions/jobs/7", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"id": 7, "steps": []}`)
+			})
+
+			_, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.attributes).To(HaveKeyWithValue("github_api_calls", 1))
+			Expect(txn.attributes).To(HaveKeyWithValue("github_pages", 0))
+		})
+
+		It("should record a span for each started step, in order", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				w.Header().Set("X-RateLimit-Remaining", "100")
+				fmt.Fprint(w, heredoc.Doc(`
+					{"total_count": 1, "jobs": [{"id": 1, "runner_name": "runner-1", "steps": [
+						{"name": "test", "conclusion": "success", "started_at": "2023-10-01T00:00:10Z", "completed_at": "2023-10-01T00:00:30Z"},
+						{"name": "setup", "conclusion": "success", "started_at": "2023-10-01T00:00:00Z", "completed_at": "2023-10-01T00:00:10Z"},
+						{"name": "instant", "conclusion": "success", "started_at": "2023-10-01T00:00:30Z", "completed_at": "2023-10-01T00:00:30Z"},
+						{"name": "skewed", "conclusion": "success", "started_at": "2023-10-01T00:00:40Z", "completed_at": "2023-10-01T00:00:35Z"},
+						{"name": "skipped", "conclusion": "skipped"}
+					]}]}
+				`))
+			})
+
+			_, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.spans).To(HaveLen(4))
+
+			var names []string
+			for _, span := range txn.spans {
+				names = append(names, span.Name)
+				Expect(span.Duration).To(BeNumerically(">=", 0))
+			}
+			Expect(names).To(Equal([]string{"setup", "test", "instant", "skewed"}))
+			Expect(txn.spans[0].Duration).To(Equal(10 * time.Second))
+			Expect(txn.spans[1].Duration).To(Equal(20 * time.Second))
+			Expect(txn.spans[3].Duration).To(BeZero())
+		})
+
+		It("should record how long the job waited for a runner", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, heredoc.Doc(`
+					{"total_count": 1, "jobs": [{"id": 1, "runner_name": "runner-1",
+						"created_at": "2023-10-01T00:00:00Z", "started_at": "2023-10-01T00:01:30Z"}]}
+				`))
+			})
+
+			_, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.metrics).To(HaveKeyWithValue("Custom/GHADebug/RunnerWaitSeconds", 90.0))
+		})
+
+		It("should not record the runner wait without both times", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, heredoc.Doc(`
+					{"total_count": 1, "jobs": [{"id": 1, "runner_name": "runner-1", "started_at": "2023-10-01T00:01:30Z"}]}
+				`))
+			})
+
+			_, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.metrics).To(BeEmpty())
+		})
+
+		It("should use the attempt scoped endpoint when the attempt is known", func() {
+			GinkgoT().Setenv("GITHUB_RUN_ATTEMPT", "2")
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "failure"))
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/attempts/2/jobs", jobsHandler("runner-1", "success"))
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status).To(Equal("success"))
+			Expect(txn.segments).To(Equal([]string{"github.ListWorkflowJobsAttempt"}))
+		})
+
+		It("should get the job directly when given the job ID", func() {
+			start.JobID = 7
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				defer GinkgoRecover()
+				Fail("jobs should not be listed")
+			})
+			mux.HandleFunc("/repos/org/repo/actions/jobs/7", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"id": 7, "runner_name": "other", "steps": [{"name": "build", "conclusion": "failure"}]}`)
+			})
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status).To(Equal("failure"))
+			Expect(txn.segments).To(Equal([]string{"github.GetWorkflowJobByID"}))
+		})
+
+		It("should time out API calls after the configured timeout", func() {
+			start.GitHubTimeout = 50 * time.Millisecond
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-r.Context().Done():
+				case <-time.After(5 * time.Second):
+				}
+			})
+
+			began := time.Now()
+			_, err := start.GitHubJobStatus(txn)
+			Expect(err).To(MatchError(context.DeadlineExceeded))
+			Expect(time.Since(began)).To(BeNumerically("<", time.Second))
+		})
+
+		It("should skip jobs with a null runner name", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, heredoc.Doc(`
+					{"total_count": 2, "jobs": [
+						{"id": 1, "status": "queued", "runner_name": null},
+						{"id": 2, "runner_name": "runner-1", "steps": [{"name": "test", "conclusion": "failure"}]}
+					]}
+				`))
+			})
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status).To(Equal("failure"))
+		})
+
+		It("should record GitHub's request ID for a failed request", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-GitHub-Request-Id", "CAFE:1234:5678")
+				w.WriteHeader(http.StatusInternalServerError)
+			})
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).To(HaveOccurred())
+			Expect(status).To(Equal("unknown"))
+			Expect(txn.attributes).To(HaveKeyWithValue("github_request_id", "CAFE:1234:5678"))
+		})
+
+		It("should not record a request ID for a successful request", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("X-GitHub-Request-Id", "CAFE:1234:5678")
+				jobsHandler("runner-1", "success")(w, r)
+			})
+
+			_, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.attributes).ToNot(HaveKey("github_request_id"))
+		})
+
+		It("should set the job URL", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"total_count": 1, "jobs": [{"id": 1, "runner_name": "runner-1", "html_url": "https://github.com/org/repo/actions/runs/42/job/1", "steps": []}]}`)
+			})
+
+			_, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.attributes).To(HaveKeyWithValue("job_url", "https://github.com/org/repo/actions/runs/42/job/1"))
+		})
+
+		It("should not set the job URL when it's missing", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "success"))
+
+			_, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(txn.attributes).ToNot(HaveKey("job_url"))
+		})
+
+		It("should report a failing step", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "failure"))
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status).To(Equal("failure"))
+			Expect(txn.errors).To(HaveLen(1))
+			Expect(txn.errors[0]).To(MatchError(`step "build" concluded with failure`))
+		})
+
+		It("should not notice errors for skipped steps", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "skipped"))
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status).To(Equal("success"))
+			Expect(txn.errors).To(BeEmpty())
+		})
+	})
+	Context("GitHubClient", func() {
+		var server *httptest.Server
+		var lookups int
+
+		BeforeEach(func() {
+			lookups = 0
+			mux = http.NewServeMux()
+			server = httptest.NewServer(mux)
+			DeferCleanup(server.Close)
+
+			start = &CliStart{Repo: "org/repo", GHAppPrivateKey: writePrivateKey()}
+			start.GHAppIDSecret = secretFile("1\n")
+			start.SetGitHubBaseURL(server.URL)
+
+			mux.HandleFunc("/repos/org/repo/installation", func(w http.ResponseWriter, r *http.Request) {
+				lookups++
+				w.Header().Set("Content-Type", "application/json")
+				fmt.Fprint(w, `{"id": 99}`)
+			})
+			mux.HandleFunc("/app/installations/99/access_tokens", tokenHandler("looked-up"))
+			mux.HandleFunc("/app/installations/7/access_tokens", tokenHandler("given"))
+		})
+
+		// jobsFor serves jobs only when authenticated with the given token
+		jobsFor := func(token string) {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get("Authorization") != "token "+token {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				jobsHandler("runner-1", "success")(w, r)
+			})
+		}
+
+		It("should look up the installation when no ID is given", func() {
+			jobsFor("looked-up")
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status).To(Equal("success"))
+			Expect(lookups).To(Equal(1))
+		})
+
+		It("should use the installation ID when given", func() {
+			start.GHAppInstallIDSecret = secretFile("7\n")
+			jobsFor("given")
+
+			status, err := start.GitHubJobStatus(txn)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(status).To(Equal("success"))
+			Expect(lookups).To(Equal(0))
+		})
+
+		Context("with debug logging", func() {
+			var logs *lockedBuffer
+
+			BeforeEach(func() {
+				logs = &lockedBuffer{}
+				log.SetOutput(logs)
+				DeferCleanup(func() {
+					log.SetOutput(os.Stderr)
+					log.SetLevel(log.InfoLevel)
+				})
+			})
+
+			It("should install the logging transport only in debug mode", func() {
+				Expect(GitHubTransport()).To(BeIdenticalTo(http.DefaultTransport))
+				log.SetLevel(log.DebugLevel)
+				Expect(GitHubTransport()).ToNot(BeIdenticalTo(http.DefaultTransport))
+			})
+
+			It("should log requests and token refreshes in debug mode", func() {
+				log.SetLevel(log.DebugLevel)
+				jobsFor("looked-up")
+
+				_, err := start.GitHubJobStatus(txn)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logs.String()).To(ContainSubstring("GitHub request"))
+				Expect(logs.String()).To(ContainSubstring("/repos/org/repo/actions/runs/42/jobs"))
+				Expect(logs.String()).To(ContainSubstring("GitHub installation token refreshed"))
+				Expect(logs.String()).ToNot(ContainSubstring("looked-up"))
+			})
+
+			It("should not log requests otherwise", func() {
+				jobsFor("looked-up")
+
+				_, err := start.GitHubJobStatus(txn)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logs.String()).ToNot(ContainSubstring("GitHub request"))
+			})
+		})
+	})
+	Context("CheckFlag", func() {
+		var path string
+
+		writePID := func(pid int) {
+			Expect(os.WriteFile(path, []byte(strconv.Itoa(pid)+"\n"), 0644)).To(Succeed())
+		}
+
+		BeforeEach(func() {
+			path = filepath.Join(GinkgoT().TempDir(), "gha-debug.flag")
+		})
+
+		It("should pass when there is no flag file", func() {
+			Expect(start.CheckFlag(path)).To(Succeed())
+		})
+
+		It("should error when the flag belongs to a live process", func() {
+			writePID(os.Getppid())
+			Expect(start.CheckFlag(path)).ToNot(Succeed())
+		})
+
+		It("should only warn with AllowExisting", func() {
+			writePID(os.Getppid())
+			start.AllowExisting = true
+			Expect(start.CheckFlag(path)).To(Succeed())
+		})
+
+		It("should pass when the flag belongs to us", func() {
+			writePID(os.Getpid())
+			Expect(start.CheckFlag(path)).To(Succeed())
+		})
+
+		It("should pass when the owning process has exited", func() {
+			cmd := exec.Command("true")
+			Expect(cmd.Run()).To(Succeed())
+			writePID(cmd.Process.Pid)
+			Expect(start.CheckFlag(path)).To(Succeed())
+		})
+	})
+	Context("TouchFile", func() {
+		var path string
+
+		BeforeEach(func() {
+			path = filepath.Join(GinkgoT().TempDir(), "nested", "gha-debug.flag")
+		})
+
+		It("should create the file and its directory", func() {
+			Expect(TouchFile(path, []byte("content"))).To(Succeed())
+			Expect(os.ReadFile(path)).To(Equal([]byte("content")))
+		})
+
+		It("should leave an existing file untouched", func() {
+			Expect(TouchFile(path, []byte("first"))).To(Succeed())
+			Expect(TouchFile(path, []byte("second"))).To(Succeed())
+			Expect(os.ReadFile(path)).To(Equal([]byte("first")))
+		})
+
+		It("should keep exactly one writer's content when touched concurrently", func() {
+			for attempt := 0; attempt < 20; attempt++ {
+				path := filepath.Join(GinkgoT().TempDir(), "gha-debug.flag")
+				contents := map[string]bool{}
+				var wg sync.WaitGroup
+				errs := make(chan error, 10)
+				for i := 0; i < 10; i++ {
+					content := fmt.Sprintf("writer-%d", i)
+					contents[content] = true
+					wg.Add(1)
+					go func() {
+						defer wg.Done()
+						errs <- TouchFile(path, []byte(content))
+					}()
+				}
+				wg.Wait()
+				close(errs)
+				for err := range errs {
+					Expect(err).ToNot(HaveOccurred())
+				}
+				data, err := os.ReadFile(path)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(contents).To(HaveKey(string(data)))
+			}
+		})
+	})
+
+	Context("StartHeartbeat", func() {
+		var buf *bytes.Buffer
+
+		BeforeEach(func() {
+			buf = &bytes.Buffer{}
+			log.SetOutput(buf)
+			DeferCleanup(log.SetOutput, os.Stderr)
+		})
+
+		It("should log while waiting longer than the interval", func() {
+			start.Heartbeat = 10 * time.Millisecond
+			stop := start.StartHeartbeat()
+			time.Sleep(50 * time.Millisecond)
+			stop()
+			stop()
+			Expect(buf.String()).To(ContainSubstring("Still waiting"))
+		})
+
+		It("should do nothing when unset", func() {
+			stop := start.StartHeartbeat()
+			time.Sleep(20 * time.Millisecond)
+			stop()
+			Expect(buf.String()).To(BeEmpty())
+		})
+	})
+
+	Context("secrets", func() {
+		BeforeEach(func() {
+			GinkgoT().Setenv("NEW_RELIC_LICENSE_KEY", "env-license")
+			GinkgoT().Setenv("GH_APP_ID", "11")
+			GinkgoT().Setenv("GH_APP_INSTALLATION_ID", "22")
+			GinkgoT().Setenv("GH_APP_PRIVATE_KEY", "env-key")
+		})
+
+		It("should fall back to the environment", func() {
+			Expect(start.NewRelicLicenseKey()).To(Equal("env-license"))
+			Expect(start.GitHubAppID()).To(Equal("11"))
+			Expect(start.GitHubAppInstallationID()).To(Equal("22"))
+			Expect(start.GitHubAppPrivateKey()).To(Equal([]byte("env-key")))
+		})
+
+		It("should prefer the secret files", func() {
+			start.NewRelicSecret = secretFile("file-license\n")
+			start.GHAppIDSecret = secretFile("1\n")
+			start.GHAppInstallIDSecret = secretFile("2\n")
+			start.GHAppPrivateKey = filepath.Join(GinkgoT().TempDir(), "key.pem")
+			Expect(os.WriteFile(start.GHAppPrivateKey, []byte("file-key"), 0600)).To(Succeed())
+
+			Expect(start.NewRelicLicenseKey()).To(Equal("file-license"))
+			Expect(start.GitHubAppID()).To(Equal("1"))
+			Expect(start.GitHubAppInstallationID()).To(Equal("2"))
+			Expect(start.GitHubAppPrivateKey()).To(Equal([]byte("file-key")))
+		})
+	})
+
+	Context("StartupJitterDelay", func() {
+		It("should be zero when off", func() {
+			Expect(start.StartupJitterDelay()).To(BeZero())
+		})
+
+		It("should stay within --startup-jitter", func() {
+			start.StartupJitter = 10 * time.Millisecond
+			for i := 0; i < 1000; i++ {
+				delay := start.StartupJitterDelay()
+				Expect(delay).To(BeNumerically(">=", 0))
+				Expect(delay).To(BeNumerically("<", start.StartupJitter))
+			}
+		})
+
+		It("should be bounded by Validate", func() {
+			start.StartupJitter = 2 * time.Minute
+			Expect(start.Validate()).To(MatchError(ContainSubstring("invalid --startup-jitter")))
+		})
+
+		It("should delay watching the flag by at most --startup-jitter", func() {
+			start.StartupJitter = 300 * time.Millisecond
+			began := time.Now()
+			_, err := runStart(start, &Cli{})
+			Expect(err).ToNot(HaveOccurred())
+			// Everything after the jitter is quick with the stdout backend
+			Expect(time.Since(began)).To(BeNumerically("<", start.StartupJitter+2*time.Second))
+		})
+	})
+
+	Context("EnsureCorrelationID", func() {
+		It("should generate a UUID when not set", func() {
+			id, err := start.EnsureCorrelationID()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(id).To(MatchRegexp(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`))
+			Expect(start.CorrelationID).To(Equal(id))
+
+			// It's stable once generated
+			Expect(start.EnsureCorrelationID()).To(Equal(id))
+		})
+
+		It("should keep an override", func() {
+			start.CorrelationID = "given"
+			Expect(start.EnsureCorrelationID()).To(Equal("given"))
+		})
+	})
+
+	Context("CustomAttributes", func() {
+		// attrFile writes content to a new --attr-file
+		attrFile := func(content string) string {
+			path := filepath.Join(GinkgoT().TempDir(), "attributes.json")
+			Expect(os.WriteFile(path, []byte(content), 0644)).To(Succeed())
+			return path
+		}
+
+		It("should merge --attr over --attr-file", func() {
+			start.AttrFile = attrFile(`{"team": "platform", "tier": "1"}`)
+			start.Attr = map[string]string{"tier": "2", "cost_center": "eng"}
+			Expect(start.CustomAttributes()).To(Equal(map[string]string{
+				"team":        "platform",
+				"tier":        "2",
+				"cost_center": "eng",
+			}))
+		})
+
+		It("should be empty without either", func() {
+			Expect(start.CustomAttributes()).To(BeEmpty())
+		})
+
+		DescribeTable("rejecting a malformed file",
+			func(content string) {
+				start.AttrFile = attrFile(content)
+				_, err := start.CustomAttributes()
+				Expect(err).To(MatchError(ContainSubstring("invalid --attr-file")))
+			},
+			Entry("with bad JSON", `{"team": `),
+			Entry("with an array", `["team"]`),
+			Entry("with a non-string value", `{"tier": 1}`),
+		)
+
+		It("should reject empty names", func() {
+			start.Attr = map[string]string{"": "value"}
+			_, err := start.CustomAttributes()
+			Expect(err).To(HaveOccurred())
+		})
+
+		It("should parse repeated --attr flags", func() {
+			cli := &Cli{}
+			Expect(cli.ParseArgs([]string{"start", "-r", "org/repo", "-w", "CI", "-j", "test", "-b", "main",
+				"--attr", "team=platform", "--attr", "tier=2"})).To(Succeed())
+			Expect(cli.Start.Attr).To(Equal(map[string]string{"team": "platform", "tier": "2"}))
+		})
+	})
+
+	Context("Validate", func() {
+		BeforeEach(func() {
+			start.TxnName = "{{.Workflow}} / {{.Job}}"
+		})
+
+		It("should accept a W3C trace ID to link", func() {
+			start.LinkTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+			Expect(start.Validate()).To(Succeed())
+		})
+
+		It("should reject an invalid trace ID to link", func() {
+			start.LinkTrace = "not-a-trace"
+			Expect(start.Validate()).To(MatchError(ContainSubstring("invalid --link-trace")))
+		})
+	})
+
+	Context("Backends", func() {
+		It("should default to newrelic", func() {
+			Expect(start.Backends()).To(Equal([]string{"newrelic"}))
+		})
+
+		It("should split a comma separated list", func() {
+			start.Backend = "newrelic, stdout"
+			Expect(start.Backends()).To(Equal([]string{"newrelic", "stdout"}))
+			Expect(start.Validate()).To(Succeed())
+		})
+
+		It("should reject unknown backends", func() {
+			start.Backend = "stdout,datadog"
+			Expect(start.Validate()).To(MatchError(ContainSubstring(`invalid --backend "datadog"`)))
+		})
+
+		It("should record to every backend", func() {
+			dir := GinkgoT().TempDir()
+			start.Backend = "stdout,stdout"
+			start.Output = filepath.Join(dir, "output.json")
+			backend, err := start.NewBackend()
+			Expect(err).ToNot(HaveOccurred())
+			backend.StartTransaction("txn").End()
+			backend.Shutdown(time.Second)
+
+			data, err := os.ReadFile(start.Output)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(strings.Count(string(data), "\n")).To(Equal(2))
+		})
+
+		Context("when a backend can't be created", func() {
+			var logs *lockedBuffer
+
+			BeforeEach(func() {
+				// NewRelic can't be created without a license key
+				GinkgoT().Setenv("NEW_RELIC_LICENSE_KEY", "")
+				logs = &lockedBuffer{}
+				log.SetOutput(logs)
+				DeferCleanup(log.SetOutput, os.Stderr)
+			})
+
+			It("should skip it and record to the others", func() {
+				start.Backend = "newrelic,stdout"
+				start.Output = filepath.Join(GinkgoT().TempDir(), "output.json")
+				backend, err := start.NewBackend()
+				Expect(err).ToNot(HaveOccurred())
+				backend.StartTransaction("txn").End()
+				backend.Shutdown(time.Second)
+
+				data, err := os.ReadFile(start.Output)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(strings.Count(string(data), "\n")).To(Equal(1))
+				Expect(logs.String()).To(ContainSubstring("Could not create backend"))
+				Expect(logs.String()).To(ContainSubstring("backend=newrelic"))
+			})
+
+			It("should return an error when none can be created", func() {
+				start.Backend = "newrelic"
+				backend, err := start.NewBackend()
+				Expect(err).To(MatchError(ContainSubstring(`backend "newrelic"`)))
+				Expect(backend).To(BeNil())
+			})
+		})
+	})
+
+	Context("AppName", func() {
+		BeforeEach(func() {
+			start.Repo = "shakefu/gha-debug"
+			start.Label = "deploys"
+		})
+
+		It("should use the repo by default", func() {
+			Expect(start.AppName()).To(Equal("GitHub Actions / shakefu/gha-debug"))
+		})
+
+		It("should use the label with --label-app-name", func() {
+			start.LabelAppName = true
+			Expect(start.AppName()).To(Equal("GitHub Actions / deploys"))
+		})
+
+		It("should fall back to the repo without a label", func() {
+			start.LabelAppName = true
+			start.Label = ""
+			Expect(start.AppName()).To(Equal("GitHub Actions / shakefu/gha-debug"))
+		})
+	})
+
+	Context("TransactionName", func() {
+		BeforeEach(func() {
+			start.Workflow = "CI"
+			start.Job = "build"
+			start.Branch = "main"
+		})
+
+		It("should use the workflow and job by default", func() {
+			start.TxnName = "{{.Workflow}} / {{.Job}}"
+			Expect(start.TransactionName()).To(Equal("CI / build"))
+		})
+
+		It("should render a custom template", func() {
+			start.TxnName = "{{.Repo}}@{{.Branch}}: {{.Job}}"
+			Expect(start.Validate()).To(Succeed())
+			Expect(start.TransactionName()).To(Equal("org/repo@main: build"))
+		})
+
+		It("should reject invalid templates", func() {
+			start.TxnName = "{{.Workflow"
+			Expect(start.Validate()).ToNot(Succeed())
+			start.TxnName = "{{.Nope}}"
+			Expect(start.Validate()).ToNot(Succeed())
+		})
+	})
+
+	Context("RunTraceID", func() {
+		BeforeEach(func() {
+			GinkgoT().Setenv("GITHUB_RUN_ATTEMPT", "1")
+			start.Job = "test"
+		})
+
+		It("should be the same for the same run, attempt and job", func() {
+			other := &CliStart{Job: "test"}
+			Expect(start.RunTraceID()).To(MatchRegexp(`^[0-9a-f]{32}$`))
+			Expect(start.RunTraceID()).To(Equal(other.RunTraceID()))
+		})
+
+		It("should follow the documented derivation", func() {
+			sum := sha256.Sum256([]byte("42:1:test"))
+			Expect(start.RunTraceID()).To(Equal(hex.EncodeToString(sum[:16])))
+		})
+
+		It("should differ between attempts and jobs", func() {
+			first := start.RunTraceID()
+			GinkgoT().Setenv("GITHUB_RUN_ATTEMPT", "2")
+			Expect(start.RunTraceID()).ToNot(Equal(first))
+			GinkgoT().Setenv("GITHUB_RUN_ATTEMPT", "1")
+			start.Job = "lint"
+			Expect(start.RunTraceID()).ToNot(Equal(first))
+		})
+	})
+
+	Context("Config", func() {
+		BeforeEach(func() {
+			GinkgoT().Setenv("NEW_RELIC_LICENSE_KEY", "")
+			GinkgoT().Setenv("GH_APP_ID", "123456")
+			GinkgoT().Setenv("GH_APP_PRIVATE_KEY", "")
+		})
+
+		It("should redact secrets from files and the environment", func() {
+			start.NewRelicSecret = kong.NamedFileContentFlag{Filename: "license", Contents: []byte("nr-license-key")}
+			config, err := start.Config(&Cli{Flag: "/tmp/gha-debug.flag"})
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(config).To(HaveKeyWithValue("NewRelicSecret", "set (14 bytes)"))
+			Expect(config).To(HaveKeyWithValue("GHAppIDSecret", "set (6 bytes)"))
+			Expect(config).To(HaveKeyWithValue("GHAppInstallIDSecret", "unset"))
+			Expect(config).To(HaveKeyWithValue("GHAppPrivateKey", "unset"))
+
+			dump, err := json.Marshal(config)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(string(dump)).ToNot(ContainSubstring("nr-license-key"))
+			Expect(string(dump)).ToNot(ContainSubstring("123456"))
+		})
+
+		It("should show the resolved options", func() {
+			start.MaxWait = 90 * time.Second
+			config, err := start.Config(&Cli{Flag: "/tmp/gha-debug.flag"})
+			Expect(err).ToNot(HaveOccurred())
+			Expect(config).To(HaveKeyWithValue("Repo", "org/repo"))
+			Expect(config).To(HaveKeyWithValue("MaxWait", "1m30s"))
+			Expect(config).To(HaveKeyWithValue("Flag", "/tmp/gha-debug.flag"))
+			Expect(config).ToNot(HaveKey("client"))
+		})
+
+		It("should print the config without running", func() {
+			cli := &Cli{Flag: filepath.Join(GinkgoT().TempDir(), "gha-debug.flag")}
+			start.ConfigDump = true
+			output := captureStdout(func() {
+				Expect(start.Run(cli)).To(Succeed())
+			})
+
+			var config map[string]interface{}
+			Expect(json.Unmarshal([]byte(output), &config)).To(Succeed())
+			Expect(config).To(HaveKeyWithValue("ConfigDump", true))
+			Expect(cli.Flag).ToNot(BeAnExistingFile())
+		})
+	})
+
+	Context("Run", func() {
+		var cli *Cli
+
+		BeforeEach(func() {
+			start.Backend = "stdout"
+			cli = &Cli{}
+		})
+
+		It("should attach a generated correlation ID", func() {
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKeyWithValue("correlation_id", MatchRegexp(`^[0-9a-f-]{36}$`)))
+		})
+
+		It("should attach the run's derived trace ID", func() {
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKeyWithValue("gha_trace_id", start.RunTraceID()))
+		})
+
+		It("should print a summary when done", func() {
+			start.Workflow = "CI"
+			start.Job = "test"
+			start.Summary = true
+			var record startRecord
+			output := captureStdout(func() {
+				var err error
+				record, err = runStart(start, cli)
+				Expect(err).ToNot(HaveOccurred())
+			})
+			Expect(output).To(ContainSubstring("CI / test"))
+			Expect(output).To(ContainSubstring("Status:  %s", record.Attributes["status"]))
+			Expect(output).To(MatchRegexp(`Waited:\s+[0-9.]+m?s`))
+		})
+
+		It("should print the summary as JSON with --summary-format json", func() {
+			start.Summary = true
+			start.SummaryFormat = "json"
+			start.CorrelationID = "correlation"
+			var record startRecord
+			output := captureStdout(func() {
+				var err error
+				record, err = runStart(start, cli)
+				Expect(err).ToNot(HaveOccurred())
+			})
+
+			var summary map[string]interface{}
+			Expect(json.Unmarshal([]byte(output), &summary)).To(Succeed())
+			Expect(summary).To(HaveKeyWithValue("status", record.Attributes["status"]))
+			Expect(summary).To(HaveKeyWithValue("waited", BeNumerically(">=", 0)))
+			Expect(summary).To(HaveKeyWithValue("run_url", record.Attributes["run_url"]))
+			Expect(summary).To(HaveKeyWithValue("correlation_id", "correlation"))
+			Expect(strings.Count(output, "\n")).To(Equal(1))
+		})
+
+		It("should not print a summary when quiet", func() {
+			start.Summary = true
+			cli.Quiet = true
+			output := captureStdout(func() {
+				_, err := runStart(start, cli)
+				Expect(err).ToNot(HaveOccurred())
+			})
+			Expect(output).To(BeEmpty())
+		})
+
+		It("should attach the runner labels and group from the environment", func() {
+			GinkgoT().Setenv("RUNNER_LABELS", "self-hosted, linux ,x64")
+			GinkgoT().Setenv("RUNNER_GROUP", "builders")
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKeyWithValue("runner_labels", "self-hosted,linux,x64"))
+			Expect(record.Attributes).To(HaveKeyWithValue("runner_group", "builders"))
+		})
+
+		It("should wait --settle-delay before getting the job status", func() {
+			start.SettleDelay = 300 * time.Millisecond
+			began := time.Now()
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(time.Since(began)).To(BeNumerically(">=", start.SettleDelay))
+			Expect(record.Attributes).To(HaveKey("status"))
+		})
+
+		It("should stop once --poll-job finds the job completed", func() {
+			job := fakeJob(1, "runner-1", "success", "failure")
+			job.Status = github.String("completed")
+			actions := &fakeActions{jobs: []*github.WorkflowJob{job}}
+			start.SetGitHubActions(actions)
+			start.JobID = 1
+			start.PollJob = 50 * time.Millisecond
+			dir := GinkgoT().TempDir()
+			start.Output = filepath.Join(dir, "output.json")
+			cli.Flag = filepath.Join(dir, "gha-debug.flag")
+
+			// Leave the flag file alone, as if the stop step never ran
+			done := make(chan error)
+			go func() {
+				done <- start.Run(cli)
+			}()
+			Eventually(done, 5).Should(Receive(BeNil()))
+			Expect(cli.Flag).ToNot(BeAnExistingFile())
+
+			var record startRecord
+			data, err := os.ReadFile(start.Output)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(json.Unmarshal(data, &record)).To(Succeed())
+			Expect(record.Attributes).To(HaveKeyWithValue("status", "failure"))
+		})
+
+		It("should keep waiting for the flag while the job is running", func() {
+			job := fakeJob(1, "runner-1", "success")
+			job.Status = github.String("in_progress")
+			start.SetGitHubActions(&fakeActions{jobs: []*github.WorkflowJob{job}})
+			start.JobID = 1
+			start.PollJob = 20 * time.Millisecond
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKeyWithValue("status", "success"))
+		})
+
+		It("should --linger after sending the data", func() {
+			start.Linger = 300 * time.Millisecond
+			dir := GinkgoT().TempDir()
+			start.Output = filepath.Join(dir, "output.json")
+			cli.Flag = filepath.Join(dir, "gha-debug.flag")
+
+			done := make(chan error)
+			go func() {
+				done <- start.Run(cli)
+			}()
+			Eventually(func() error {
+				_, err := os.Stat(cli.Flag)
+				return err
+			}).Should(Succeed())
+			Expect(os.Remove(cli.Flag)).To(Succeed())
+
+			// The record is written well before we're allowed to return
+			Eventually(func() ([]byte, error) {
+				return os.ReadFile(start.Output)
+			}).ShouldNot(BeEmpty())
+			flushed := time.Now()
+			Consistently(done, 0.15).ShouldNot(Receive())
+			Eventually(done, 5).Should(Receive(BeNil()))
+			Expect(time.Since(flushed)).To(BeNumerically("~", start.Linger, 200*time.Millisecond))
+		})
+
+		It("should record numeric attributes as numbers", func() {
+			GinkgoT().Setenv("GITHUB_RUN_ID", "6322221331")
+			GinkgoT().Setenv("GITHUB_RUN_NUMBER", "17")
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKeyWithValue("run_id", 6322221331.0))
+			Expect(record.Attributes).To(HaveKeyWithValue("run_number", 17.0))
+			Expect(record.Attributes).To(HaveKeyWithValue("wait_seconds", BeNumerically(">", 0)))
+		})
+
+		It("should fall back to strings for attributes which aren't numbers", func() {
+			GinkgoT().Setenv("GITHUB_RUN_NUMBER", "seventeen")
+			GinkgoT().Setenv("GITHUB_RUN_ID", "")
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKeyWithValue("run_number", "seventeen"))
+			Expect(record.Attributes).To(HaveKeyWithValue("run_id", ""))
+		})
+
+		Context("with a memory flag", func() {
+			var flag *memoryFlag
+			var done chan error
+
+			BeforeEach(func() {
+				flag = newMemoryFlag()
+				start.SetFlag(flag)
+				dir := GinkgoT().TempDir()
+				start.Output = filepath.Join(dir, "output.json")
+				cli.Flag = filepath.Join(dir, "gha-debug.flag")
+				done = make(chan error)
+			})
+
+			run := func() {
+				go func(start *CliStart, cli *Cli, done chan error) {
+					done <- start.Run(cli)
+				}(start, cli, done)
+			}
+
+			It("should run the whole lifecycle from the flag", func() {
+				run()
+				Consistently(done, 0.05).ShouldNot(Receive())
+				flag.Start()
+				Eventually(flag.Waiting).Should(BeTrue())
+				Consistently(done, 0.05).ShouldNot(Receive())
+				Expect(flag.Release()).To(Succeed())
+				Eventually(done, 5).Should(Receive(BeNil()))
+
+				var record startRecord
+				data, err := os.ReadFile(start.Output)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(data, &record)).To(Succeed())
+				Expect(record.Attributes).To(HaveKeyWithValue("start_source", "memory"))
+				Expect(record.Attributes).To(HaveKey("status"))
+			})
+
+			It("should give up with --max-wait", func() {
+				start.MaxWait = 50 * time.Millisecond
+				run()
+				flag.Start()
+				Eventually(done, 5).Should(Receive(BeNil()))
+
+				var record startRecord
+				data, err := os.ReadFile(start.Output)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(data, &record)).To(Succeed())
+				Expect(record.Attributes).To(HaveKeyWithValue("status", "max_wait_exceeded"))
+				Expect(record.Attributes).To(HaveKeyWithValue("wait_seconds", BeNumerically(">=", 0.05)))
+			})
+
+			It("should stop by itself after --auto-stop", func() {
+				start.AutoStop = 100 * time.Millisecond
+				run()
+				// The timer only runs once the session begins
+				Consistently(done, 0.2).ShouldNot(Receive())
+				flag.Start()
+				Eventually(done, 5).Should(Receive(BeNil()))
+
+				var record startRecord
+				data, err := os.ReadFile(start.Output)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(data, &record)).To(Succeed())
+				Expect(record.Attributes).To(HaveKeyWithValue("status", Not(Equal("max_wait_exceeded"))))
+				Expect(record.Attributes).To(HaveKeyWithValue("wait_seconds", BeNumerically(">=", 0.1)))
+			})
+		})
+
+		Context("with --no-touch", func() {
+			var done chan error
+
+			BeforeEach(func() {
+				start.NoTouch = true
+				dir := GinkgoT().TempDir()
+				start.Output = filepath.Join(dir, "output.json")
+				cli.Flag = filepath.Join(dir, "gha-debug.flag")
+				done = make(chan error)
+			})
+
+			run := func() {
+				go func(start *CliStart, cli *Cli, done chan error) {
+					done <- start.Run(cli)
+				}(start, cli, done)
+			}
+
+			It("should leave the whole flag lifecycle to someone else", func() {
+				run()
+				// Nothing is created for us, however long we wait
+				Consistently(cli.Flag, 0.2).ShouldNot(BeAnExistingFile())
+
+				// The orchestrator owns the file, and doesn't know our token
+				Expect(os.WriteFile(cli.Flag, []byte("external\n"), 0644)).To(Succeed())
+				Consistently(done, 0.2).ShouldNot(Receive())
+				Expect(os.ReadFile(cli.Flag)).To(Equal([]byte("external\n")))
+
+				Expect(os.Remove(cli.Flag)).To(Succeed())
+				Eventually(done, 5).Should(Receive(BeNil()))
+				Expect(start.Output).To(BeAnExistingFile())
+			})
+
+			It("should leave the flag file alone when giving up", func() {
+				start.MaxWait = 100 * time.Millisecond
+				Expect(os.WriteFile(cli.Flag, []byte("external\n"), 0644)).To(Succeed())
+				run()
+				Eventually(done, 5).Should(Receive(BeNil()))
+				Expect(cli.Flag).To(BeAnExistingFile())
+			})
+
+			It("should not be used with --reset-flag, --listen or --auto-stop", func() {
+				start.ResetFlag = true
+				Expect(start.Validate()).To(MatchError(ContainSubstring("--no-touch")))
+				start.ResetFlag = false
+				start.Listen = "127.0.0.1:0"
+				Expect(start.Validate()).To(MatchError(ContainSubstring("--no-touch")))
+				start.Listen = ""
+				start.AutoStop = time.Minute
+				Expect(start.Validate()).To(MatchError(ContainSubstring("--no-touch")))
+			})
+		})
+
+		It("should record the run conclusion with --run-conclusion", func() {
+			actions := &fakeActions{
+				jobs: []*github.WorkflowJob{fakeJob(1, "runner-1", "success")},
+				run:  &github.WorkflowRun{Conclusion: github.String("failure")},
+			}
+			start.SetGitHubActions(actions)
+			start.RunConclusion = true
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKeyWithValue("status", "success"))
+			Expect(record.Attributes).To(HaveKeyWithValue("run_conclusion", "failure"))
+		})
+
+		It("should not get the run conclusion by default", func() {
+			actions := &fakeActions{
+				jobs: []*github.WorkflowJob{fakeJob(1, "runner-1", "success")},
+				run:  &github.WorkflowRun{Conclusion: github.String("failure")},
+			}
+			start.SetGitHubActions(actions)
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).ToNot(HaveKey("run_conclusion"))
+			Expect(actions.calls).ToNot(ContainElement("GetWorkflowRunByID"))
+		})
+
+		It("should add custom attributes", func() {
+			start.Attr = map[string]string{"team": "platform"}
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKeyWithValue("team", "platform"))
+		})
+
+		It("should add the --label attribute", func() {
+			start.Label = "deploys"
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKeyWithValue("label", "deploys"))
+		})
+
+		It("should leave out an empty label", func() {
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).ToNot(HaveKey("label"))
+		})
+
+		It("should leave out missing runner labels and group", func() {
+			GinkgoT().Setenv("RUNNER_LABELS", "")
+			GinkgoT().Setenv("RUNNER_GROUP", "")
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).ToNot(HaveKey("runner_labels"))
+			Expect(record.Attributes).ToNot(HaveKey("runner_group"))
+		})
+
+		It("should rename the status attribute with --status-attr", func() {
+			start.StatusAttr = "job_status"
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKey("job_status"))
+			Expect(record.Attributes).ToNot(HaveKey("status"))
+		})
+
+		It("should prefix every attribute with --attr-prefix", func() {
+			start.StatusAttr = "job_status"
+			start.AttrPrefix = "gha."
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKey("gha.job_status"))
+			Expect(record.Attributes).To(HaveKey("gha.correlation_id"))
+			for key := range record.Attributes {
+				Expect(key).To(HavePrefix("gha."))
+			}
+		})
+
+		It("should accept a traceparent from the environment", func() {
+			traceparent := "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01"
+			GinkgoT().Setenv("TRACEPARENT", traceparent)
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Parent).To(Equal(traceparent))
+		})
+
+		It("should link to the --link-trace trace", func() {
+			start.LinkTrace = "4bf92f3577b34da6a3ce929d0e0e4736"
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Links).To(Equal([]string{"4bf92f3577b34da6a3ce929d0e0e4736"}))
+		})
+
+		It("should not set a parent without a traceparent", func() {
+			GinkgoT().Setenv("TRACEPARENT", "")
+			GinkgoT().Setenv("traceparent", "")
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Parent).To(BeEmpty())
+		})
+
+		Context("with hooks", func() {
+			var logs *lockedBuffer
+
+			BeforeEach(func() {
+				logs = &lockedBuffer{}
+				log.SetOutput(logs)
+				DeferCleanup(log.SetOutput, os.Stderr)
+			})
+
+			It("should run --on-start and --on-stop and log their output", func() {
+				marker := filepath.Join(GinkgoT().TempDir(), "order")
+				start.OnStart = "echo start-hook-ran; echo start >> " + marker
+				start.OnStop = "echo stop-hook-ran; echo stop >> " + marker
+				_, err := runStart(start, cli)
+				Expect(err).ToNot(HaveOccurred())
+
+				Expect(logs.String()).To(ContainSubstring("start-hook-ran"))
+				Expect(logs.String()).To(ContainSubstring("stop-hook-ran"))
+				Expect(os.ReadFile(marker)).To(Equal([]byte("start\nstop\n")))
+			})
+
+			It("should only warn when a hook fails", func() {
+				start.OnStart = "echo broken; exit 3"
+				_, err := runStart(start, cli)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(logs.String()).To(ContainSubstring("broken"))
+				Expect(logs.String()).To(ContainSubstring("Hook failed"))
+			})
+		})
+
+		Context("with --listen", func() {
+			var addr string
+
+			BeforeEach(func() {
+				// Find a free port for the control server
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).ToNot(HaveOccurred())
+				addr = listener.Addr().String()
+				Expect(listener.Close()).To(Succeed())
+
+				start.Listen = addr
+				start.Output = filepath.Join(GinkgoT().TempDir(), "output.json")
+				cli.Flag = filepath.Join(GinkgoT().TempDir(), "gha-debug.flag")
+			})
+
+			// runInBackground runs start until it's listening for stops
+			runInBackground := func() chan error {
+				done := make(chan error, 1)
+				start, cli := start, cli
+				go func() {
+					done <- start.Run(cli)
+				}()
+				Eventually(func() error {
+					conn, err := net.Dial("tcp", addr)
+					if err == nil {
+						conn.Close()
+					}
+					return err
+				}).Should(Succeed())
+				return done
+			}
+
+			It("should stop when POST /stop is called", func() {
+				done := runInBackground()
+				Consistently(done, 0.1).ShouldNot(Receive())
+
+				resp, err := http.Post("http://"+addr+"/stop", "text/plain", nil)
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+
+				var runErr error
+				Eventually(done, 5).Should(Receive(&runErr))
+				Expect(runErr).ToNot(HaveOccurred())
+				Expect(cli.Flag).ToNot(BeAnExistingFile())
+
+				// The server is shut down with us
+				_, err = net.Dial("tcp", addr)
+				Expect(err).To(HaveOccurred())
+			})
+
+			It("should only stop on a POST", func() {
+				done := runInBackground()
+
+				resp, err := http.Get("http://" + addr + "/stop")
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusMethodNotAllowed))
+				Consistently(done, 0.3).ShouldNot(Receive())
+
+				Expect(os.Remove(cli.Flag)).To(Succeed())
+				Eventually(done, 5).Should(Receive())
+			})
+
+			It("should fail when it can't listen", func() {
+				listener, err := net.Listen("tcp", "127.0.0.1:0")
+				Expect(err).ToNot(HaveOccurred())
+				defer listener.Close()
+				start.Listen = listener.Addr().String()
+
+				start.OnStart = "touch " + filepath.Join(filepath.Dir(cli.Flag), "started")
+				err = start.Run(cli)
+				Expect(err).To(MatchError(ContainSubstring("could not listen for stop requests")))
+				// Nothing was started before we found out
+				Expect(cli.Flag).ToNot(BeAnExistingFile())
+				Expect(filepath.Join(filepath.Dir(cli.Flag), "started")).ToNot(BeAnExistingFile())
+			})
+
+			It("should release an injected flag on POST /stop", func() {
+				flag := newMemoryFlag()
+				start.SetFlag(flag)
+				done := runInBackground()
+				flag.Start()
+				Eventually(flag.Waiting).Should(BeTrue())
+
+				resp, err := http.Post("http://"+addr+"/stop", "text/plain", nil)
+				Expect(err).ToNot(HaveOccurred())
+				resp.Body.Close()
+				Expect(resp.StatusCode).To(Equal(http.StatusOK))
+				Eventually(done, 5).Should(Receive(BeNil()))
+			})
+		})
+
+		Context("with --result-file", func() {
+			// result decodes the result file
+			result := func() (result map[string]interface{}) {
+				data, err := os.ReadFile(start.ResultFile)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(json.Unmarshal(data, &result)).To(Succeed())
+				return
+			}
+
+			BeforeEach(func() {
+				start.ResultFile = filepath.Join(GinkgoT().TempDir(), "results", "result.json")
+			})
+
+			It("should write a successful result", func() {
+				mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "success"))
+				_, err := runStart(start, cli)
+				Expect(err).ToNot(HaveOccurred())
+				Expect(result()).To(And(
+					HaveKeyWithValue("status", "success"),
+					HaveKeyWithValue("waited", BeNumerically(">", 0)),
+					HaveKeyWithValue("run_url", "https://github.com/org/repo/actions/runs/42"),
+					HaveKeyWithValue("correlation_id", start.CorrelationID),
+					Not(HaveKey("error")),
+				))
+			})
+
+			It("should write a failed result with the error", func() {
+				mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "failure"))
+				start.FailOnStatus = true
+				_, err := runStart(start, cli)
+				Expect(err).To(HaveOccurred())
+				Expect(result()).To(And(
+					HaveKeyWithValue("status", "failure"),
+					HaveKeyWithValue("error", "job finished with status failure"),
+				))
+			})
+
+			It("should write a result when giving up waiting", func() {
+				dir := GinkgoT().TempDir()
+				start.Output = filepath.Join(dir, "output.json")
+				cli.Flag = filepath.Join(dir, "gha-debug.flag")
+				start.MaxWait = 100 * time.Millisecond
+				Expect(start.Run(cli)).To(Succeed())
+				Expect(result()).To(HaveKeyWithValue("status", "max_wait_exceeded"))
+			})
+
+			It("should write a result when start fails", func() {
+				parent := filepath.Join(GinkgoT().TempDir(), "parent")
+				Expect(os.WriteFile(parent, nil, 0644)).To(Succeed())
+				cli.Flag = filepath.Join(parent, "gha-debug.flag")
+				Expect(start.Run(cli)).ToNot(Succeed())
+				Expect(result()).To(And(
+					HaveKeyWithValue("status", "error"),
+					HaveKeyWithValue("error", ContainSubstring("could not create flag file")),
+				))
+			})
+		})
+
+		Context("with --metrics-file", func() {
+			// sample matches an OpenMetrics sample line, capturing its name,
+			// labels and value
+			sample := regexp.MustCompile(`^([a-z_]+)\{((?:[a-z_]+="(?:[^"\\]|\\.)*",?)*)\} (\S+)$`)
+			label := regexp.MustCompile(`([a-z_]+)="((?:[^"\\]|\\.)*)"`)
+
+			// metrics parses the metrics file into the labels and value of each
+			// sample, by name, checking every line is valid as it goes
+			metrics := func() map[string]map[string]string {
+				data, err := os.ReadFile(start.MetricsFile)
+				Expect(err).ToNot(HaveOccurred())
+				lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+				Expect(lines[len(lines)-1]).To(Equal("# EOF"))
+
+				samples := map[string]map[string]string{}
+				for _, line := range lines[:len(lines)-1] {
+					if strings.HasPrefix(line, "# HELP ") || strings.HasPrefix(line, "# TYPE ") {
+						continue
+					}
+					match := sample.FindStringSubmatch(line)
+					Expect(match).ToNot(BeNil(), line)
+					labels := map[string]string{"value": match[3]}
+					for _, l := range label.FindAllStringSubmatch(match[2], -1) {
+						labels[l[1]] = l[2]
+					}
+					samples[match[1]] = labels
+				}
+				return samples
+			}
+
+			BeforeEach(func() {
+				start.MetricsFile = filepath.Join(GinkgoT().TempDir(), "textfile", "gha-debug.prom")
+				start.Workflow = "CI"
+				start.Job = "test"
+				start.Branch = `feature/"quoted"`
+			})
+
+			It("should write the wait time and status", func() {
+				mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "failure"))
+				_, err := runStart(start, cli)
+				Expect(err).ToNot(HaveOccurred())
+
+				samples := metrics()
+				Expect(samples).To(HaveKeyWithValue("gha_debug_wait_seconds", And(
+					HaveKeyWithValue("repo", "org/repo"),
+					HaveKeyWithValue("workflow", "CI"),
+					HaveKeyWithValue("job", "test"),
+					HaveKeyWithValue("branch", `feature/\"quoted\"`),
+					HaveKeyWithValue("runner", "runner-1"),
+					HaveKeyWithValue("value", WithTransform(func(v string) (float64, error) {
+						return strconv.ParseFloat(v, 64)
+					}, BeNumerically(">", 0))),
+				)))
+				Expect(samples).To(HaveKeyWithValue("gha_debug_job_status", And(
+					HaveKeyWithValue("status", "failure"),
+					HaveKeyWithValue("value", "1"),
+				)))
+			})
+
+			It("should write an error status when start fails", func() {
+				parent := filepath.Join(GinkgoT().TempDir(), "parent")
+				Expect(os.WriteFile(parent, nil, 0644)).To(Succeed())
+				cli.Flag = filepath.Join(parent, "gha-debug.flag")
+				Expect(start.Run(cli)).ToNot(Succeed())
+				Expect(metrics()).To(HaveKeyWithValue("gha_debug_job_status", HaveKeyWithValue("status", "error")))
+			})
+		})
+
+		Context("with an existing flag file", func() {
+			// resumed runs start, which gives up after MaxWait since nothing
+			// removes the flag, and returns whether it resumed the flag
+			resumed := func() interface{} {
+				Expect(start.Run(cli)).To(Succeed())
+				data, err := os.ReadFile(start.Output)
+				Expect(err).ToNot(HaveOccurred())
+				var record startRecord
+				Expect(json.Unmarshal(data, &record)).To(Succeed())
+				return record.Attributes["resumed"]
+			}
+
+			BeforeEach(func() {
+				dir := GinkgoT().TempDir()
+				cli.Flag = filepath.Join(dir, "gha-debug.flag")
+				start.Output = filepath.Join(dir, "output.json")
+				start.MaxWait = 200 * time.Millisecond
+				Expect(os.WriteFile(cli.Flag, []byte("crashed\n"), 0644)).To(Succeed())
+			})
+
+			It("should resume it by default", func() {
+				Expect(resumed()).To(BeTrue())
+			})
+
+			It("should replace it with --reset-flag", func() {
+				start.ResetFlag = true
+				Expect(resumed()).To(BeFalse())
+			})
+		})
+
+		It("should give up after --max-wait", func() {
+			dir := GinkgoT().TempDir()
+			start.Output = filepath.Join(dir, "output.json")
+			cli.Flag = filepath.Join(dir, "gha-debug.flag")
+			start.MaxWait = 200 * time.Millisecond
+
+			// Nothing removes the flag
+			Expect(start.Run(cli)).To(Succeed())
+			Expect(cli.Flag).ToNot(BeAnExistingFile())
+
+			data, err := os.ReadFile(start.Output)
+			Expect(err).ToNot(HaveOccurred())
+			var record startRecord
+			Expect(json.Unmarshal(data, &record)).To(Succeed())
+			Expect(record.Attributes).To(HaveKeyWithValue("status", "max_wait_exceeded"))
+		})
+
+		It("should succeed on a successful job with --fail-on-status", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "success"))
+			start.FailOnStatus = true
+			record, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(record.Attributes).To(HaveKeyWithValue("status", "success"))
+		})
+
+		It("should fail on a failed job with --fail-on-status", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "failure"))
+			start.FailOnStatus = true
+			record, err := runStart(start, cli)
+			Expect(err).To(MatchError("job finished with status failure"))
+			// The data is still sent first
+			Expect(record.Attributes).To(HaveKeyWithValue("status", "failure"))
+		})
+
+		It("should succeed on a failed job without --fail-on-status", func() {
+			mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "failure"))
+			_, err := runStart(start, cli)
+			Expect(err).ToNot(HaveOccurred())
+		})
+
+		Context("exit codes", func() {
+			It("should be 0 for a successful run", func() {
+				mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "success"))
+				start.FailOnStatus = true
+				_, err := runStart(start, cli)
+				Expect(ExitCode(err)).To(Equal(0))
+			})
+
+			It("should be ExitJobFailed for a failed job with --fail-on-status", func() {
+				mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", jobsHandler("runner-1", "failure"))
+				start.FailOnStatus = true
+				_, err := runStart(start, cli)
+				Expect(ExitCode(err)).To(Equal(ExitJobFailed))
+			})
+
+			It("should be ExitMaxWait for giving up with --fail-on-status", func() {
+				dir := GinkgoT().TempDir()
+				start.Output = filepath.Join(dir, "output.json")
+				cli.Flag = filepath.Join(dir, "gha-debug.flag")
+				start.MaxWait = 100 * time.Millisecond
+				start.FailOnStatus = true
+				err := start.Run(cli)
+				Expect(err).To(MatchError(ContainSubstring("gave up waiting")))
+				Expect(ExitCode(err)).To(Equal(ExitMaxWait))
+			})
+
+			It("should be ExitGitHubAuth when the API refuses our credentials with --fail-on-status", func() {
+				mux.HandleFunc("/repos/org/repo/actions/runs/42/jobs", func(w http.ResponseWriter, r *http.Request) {
+					w.WriteHeader(http.StatusUnauthorized)
+				})
+				start.FailOnStatus = true
+				record, err := runStart(start, cli)
+				Expect(ExitCode(err)).To(Equal(ExitGitHubAuth))
+				Expect(record.Attributes).To(HaveKeyWithValue("status", "unknown"))
+			})
+
+			It("should be ExitGitHubAuth without GitHub credentials with --fail-on-status", func() {
+				for _, name := range []string{"GH_APP_ID", "GH_APP_PRIVATE_KEY"} {
+					GinkgoT().Setenv(name, "")
+				}
+				start.SetGitHubClient(nil)
+				start.FailOnStatus = true
+				_, err := runStart(start, cli)
+				Expect(ExitCode(err)).To(Equal(ExitGitHubAuth))
+			})
+
+			It("should be 0 when GitHub authentication fails without --fail-on-status", func() {
+				start.SetGitHubClient(nil)
+				_, err := runStart(start, cli)
+				Expect(ExitCode(err)).To(Equal(0))
+			})
+
+			It("should be ExitFailure for other errors", func() {
+				Expect(ExitCode(errors.New("boom"))).To(Equal(ExitFailure))
+				wrapped := fmt.Errorf("wrapped: %w", &ExitError{Code: ExitMaxWait, Err: errors.New("boom")})
+				Expect(ExitCode(wrapped)).To(Equal(ExitMaxWait))
+			})
+		})
+
+		Context("with an invalid license key", func() {
+			var logs *lockedBuffer
+
+			BeforeEach(func() {
+				start.Backend = "newrelic"
+				start.NewRelicSecret = secretFile(strings.Repeat("0", 40))
+				start.ConnectTimeout = 50 * time.Millisecond
+				cli.Flag = filepath.Join(GinkgoT().TempDir(), "gha-debug.flag")
+
+				logs = &lockedBuffer{}
+				log.SetOutput(logs)
+				DeferCleanup(log.SetOutput, os.Stderr)
+			})
+
+			It("should warn and carry on without a connection", func() {
+				done := make(chan error)
+				go func() {
+					done <- start.Run(cli)
+				}()
+
+				Eventually(func() error {
+					_, err := os.Stat(cli.Flag)
+					return err
+				}).Should(Succeed())
+				Expect(logs.String()).To(ContainSubstring("Could not connect to backend"))
+
+				Expect(os.Remove(cli.Flag)).To(Succeed())
+				Eventually(done, 5).Should(Receive(BeNil()))
+			})
+
+			It("should return an error with --require-connection", func() {
+				start.RequireConnection = true
+				err := start.Run(cli)
+				Expect(err).To(MatchError(ContainSubstring("could not connect to backend")))
+				Expect(ExitCode(err)).To(Equal(ExitConnectTimeout))
+				Expect(cli.Flag).ToNot(BeAnExistingFile())
+			})
+		})
+
+		It("should return an error when the flag can't be created", func() {
+			// A file where the flag's directory should be
+			parent := filepath.Join(GinkgoT().TempDir(), "parent")
+			Expect(os.WriteFile(parent, nil, 0644)).To(Succeed())
+			cli.Flag = filepath.Join(parent, "gha-debug.flag")
+
+			err := start.Run(cli)
+			Expect(err).To(MatchError(ContainSubstring("could not create flag file")))
+		})
+
+		It("should return an error when the flag directory isn't writable", func() {
+			if os.Geteuid() == 0 {
+				Skip("permissions aren't enforced for root")
+			}
+			dir := filepath.Join(GinkgoT().TempDir(), "readonly")
+			Expect(os.Mkdir(dir, 0555)).To(Succeed())
+			cli.Flag = filepath.Join(dir, "gha-debug.flag")
+
+			err := start.Run(cli)
+			Expect(err).To(MatchError(os.ErrPermission))
+		})
+	})
+})
+
+var _ = Describe("Backend", func() {
+	Context("NewWriterBackend", func() {
+		It("should write each transaction as a JSON line", func() {
+			buf := &bytes.Buffer{}
+			backend := NewWriterBackend(buf)
+			Expect(backend.WaitForConnection(time.Second)).To(Succeed())
+
+			txn := backend.StartTransaction("workflow / job")
+			txn.AddAttribute("status", "success")
+			txn.StartSegment("segment").End()
+			txn.NoticeError(errors.New("failed"))
+			txn.RecordSpan(Span{Name: "step", Start: time.Now(), Duration: time.Second})
+			txn.RecordMetric("Custom/GHADebug/RunnerWaitSeconds", 12)
+			txn.End()
+			// Ending again shouldn't write another record
+			txn.End()
+			backend.Shutdown(time.Second)
+
+			var record map[string]interface{}
+			decoder := json.NewDecoder(buf)
+			Expect(decoder.Decode(&record)).To(Succeed())
+			Expect(decoder.More()).To(BeFalse())
+
+			Expect(record).To(HaveKeyWithValue("name", "workflow / job"))
+			Expect(record).To(HaveKeyWithValue("attributes", HaveKeyWithValue("status", "success")))
+			Expect(record).To(HaveKeyWithValue("duration", BeNumerically(">=", 0)))
+			Expect(record).To(HaveKeyWithValue("errors", ConsistOf("failed")))
+			Expect(record).To(HaveKeyWithValue("spans", ConsistOf(And(
+				HaveKeyWithValue("name", "step"),
+				HaveKeyWithValue("duration", 1.0),
+			))))
+			Expect(record).To(HaveKeyWithValue("metrics", HaveKeyWithValue("Custom/GHADebug/RunnerWaitSeconds", 12.0)))
+		})
+	})
+
+	Context("LimitAttributes", func() {
+		var fake *fakeTxn
+		var txn Transaction
+		var logs *lockedBuffer
+
+		BeforeEach(func() {
+			logs = &lockedBuffer{}
+			log.SetOutput(logs)
+			DeferCleanup(log.SetOutput, os.Stderr)
+			fake = newFakeTxn()
+			txn = LimitAttributes(fake)
+		})
+
+		It("should truncate long values and warn about them", func() {
+			txn.AddAttribute("run_url", strings.Repeat("a", 300))
+			txn.AddAttribute("short", "value")
+			txn.AddAttribute("count", 42)
+			Expect(logs.String()).ToNot(ContainSubstring("truncated"))
+			txn.End()
+
+			value := fake.attributes["run_url"].(string)
+			Expect(value).To(HaveLen(255))
+			Expect(value).To(HaveSuffix("..."))
+			Expect(fake.attributes).To(HaveKeyWithValue("short", "value"))
+			Expect(fake.attributes).To(HaveKeyWithValue("count", 42))
+			Expect(logs.String()).To(ContainSubstring("truncated"))
+			Expect(logs.String()).To(ContainSubstring("keys=run_url"))
+		})
+
+		It("should not split a character when truncating", func() {
+			txn.AddAttribute("emoji", strings.Repeat("é", 200))
+			value := fake.attributes["emoji"].(string)
+			Expect(len(value)).To(BeNumerically("<=", 255))
+			Expect(utf8.ValidString(value)).To(BeTrue())
+		})
+
+		It("should drop attributes past the limit and warn about them", func() {
+			for i := 0; i < 70; i++ {
+				txn.AddAttribute(fmt.Sprintf("attr_%02d", i), i)
+			}
+			// Updating an attribute we already have is still allowed
+			txn.AddAttribute("attr_00", "updated")
+			txn.End()
+
+			Expect(fake.attributes).To(HaveLen(64))
+			Expect(fake.attributes).To(HaveKeyWithValue("attr_00", "updated"))
+			Expect(fake.attributes).ToNot(HaveKey("attr_64"))
+			Expect(logs.String()).To(ContainSubstring("dropped"))
+			Expect(logs.String()).To(ContainSubstring("attr_64,attr_65"))
+		})
+
+		It("should limit traces linked with an attribute", func() {
+			txn = LimitAttributes(LinkingByAttribute(fake))
+			txn.LinkTrace(strings.Repeat("a", 300))
+			txn.End()
+
+			value := fake.attributes["linked_trace_id"].(string)
+			Expect(value).To(HaveLen(255))
+			Expect(logs.String()).To(ContainSubstring("keys=linked_trace_id"))
+		})
+	})
+
+	Context("NewMultiBackend", func() {
+		It("should send attributes to every backend", func() {
+			buf := &bytes.Buffer{}
+			fake := &fakeBackend{}
+			backend := NewMultiBackend(fake, NewWriterBackend(buf))
+			Expect(backend.WaitForConnection(time.Second)).To(Succeed())
+
+			txn := backend.StartTransaction("workflow / job")
+			txn.AddAttribute("status", "success")
+			txn.StartSegment("segment").End()
+			txn.End()
+			Expect(backend.ShutdownContext(context.Background())).To(Succeed())
+
+			Expect(fake.txns).To(HaveLen(1))
+			Expect(fake.txns[0].attributes).To(HaveKeyWithValue("status", "success"))
+			Expect(fake.txns[0].segments).To(Equal([]string{"segment"}))
+			var record map[string]interface{}
+			Expect(json.Unmarshal(buf.Bytes(), &record)).To(Succeed())
+			Expect(record).To(HaveKeyWithValue("attributes", HaveKeyWithValue("status", "success")))
+		})
+
+		It("should still record to the others when one can't connect", func() {
+			buf := &bytes.Buffer{}
+			fake := &fakeBackend{connectErr: errors.New("no route")}
+			backend := NewMultiBackend(fake, NewWriterBackend(buf))
+			Expect(backend.WaitForConnection(time.Second)).To(MatchError("no route"))
+
+			txn := backend.StartTransaction("workflow / job")
+			txn.AddAttribute("status", "success")
+			txn.End()
+			Expect(buf.String()).To(ContainSubstring(`"status":"success"`))
+		})
+	})
+
+	Context("ShutdownContext", func() {
+		var closer *blockingCloser
+		var backend Backend
+
+		BeforeEach(func() {
+			closer = &blockingCloser{release: make(chan struct{}), closed: make(chan struct{})}
+			DeferCleanup(closer.Release)
+			backend = NewClosingWriterBackend(&bytes.Buffer{}, closer)
+		})
+
+		It("should wait for the shutdown to finish", func() {
+			closer.Release()
+			Expect(backend.ShutdownContext(context.Background())).To(Succeed())
+			Expect(closer.closed).To(BeClosed())
+		})
+
+		It("should return early when cancelled mid-shutdown", func() {
+			logs := &lockedBuffer{}
+			log.SetOutput(logs)
+			DeferCleanup(log.SetOutput, os.Stderr)
+
+			ctx, cancel := context.WithCancel(context.Background())
+			result := make(chan error, 1)
+			go func() {
+				result <- backend.ShutdownContext(ctx)
+			}()
+			Consistently(result, 0.1).ShouldNot(Receive())
+
+			cancel()
+			Eventually(result).Should(Receive(MatchError(context.Canceled)))
+			Expect(closer.closed).ToNot(BeClosed())
+			Expect(logs.String()).To(ContainSubstring("may be dropped"))
+		})
+
+		It("should give up at the context's deadline", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			Expect(backend.ShutdownContext(ctx)).To(MatchError(context.DeadlineExceeded))
+		})
+	})
+})
+
+// blockingCloser is an io.Closer which doesn't finish closing until released
+type blockingCloser struct {
+	release chan struct{}
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (c *blockingCloser) Close() error {
+	<-c.release
+	close(c.closed)
+	return nil
+}
+
+// Release lets Close finish
+func (c *blockingCloser) Release() {
+	c.once.Do(func() { close(c.release) })
+}
+
+// lockedBuffer is a bytes.Buffer which is safe to log to from goroutines while
+// we read it
+type lockedBuffer struct {
+	buf bytes.Buffer
+	m   sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.String()
+}
+
+// captureStdout returns everything written to stdout while f runs
+func captureStdout(f func()) string {
+	r, w, err := os.Pipe()
+	Expect(err).ToNot(HaveOccurred())
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	output := make(chan string)
+	go func() {
+		var buf bytes.Buffer
+		_, _ = buf.ReadFrom(r)
+		output <- buf.String()
+	}()
+
+	f()
+	w.Close()
+	return <-output
+}
+
+var _ = Describe("CliStop", func() {
+	var cli *Cli
+	var dir string
+
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		cli = &Cli{Flag: filepath.Join(dir, "gha-debug.flag")}
+	})
+
+	It("should remove the flag file", func() {
+		Expect(os.WriteFile(cli.Flag, nil, 0644)).To(Succeed())
+		Expect((&CliStop{}).Run(cli)).To(Succeed())
+		Expect(cli.Flag).ToNot(BeAnExistingFile())
+	})
+
+	It("should remove every flag file matching --glob", func() {
+		flags := []string{"run-1.flag", "run-2.flag", "run-3.flag"}
+		for _, name := range append(flags, "other.txt") {
+			Expect(os.WriteFile(filepath.Join(dir, name), nil, 0644)).To(Succeed())
+		}
+		// Directories match too, but are left alone
+		Expect(os.Mkdir(filepath.Join(dir, "run-4.flag"), 0755)).To(Succeed())
+
+		Expect((&CliStop{Glob: filepath.Join(dir, "run-*.flag")}).Run(cli)).To(Succeed())
+		for _, name := range flags {
+			Expect(filepath.Join(dir, name)).ToNot(BeAnExistingFile())
+		}
+		Expect(filepath.Join(dir, "other.txt")).To(BeAnExistingFile())
+		Expect(filepath.Join(dir, "run-4.flag")).To(BeADirectory())
+	})
+
+	It("should leave --flag alone with --glob", func() {
+		Expect(os.WriteFile(cli.Flag, nil, 0644)).To(Succeed())
+		Expect((&CliStop{Glob: filepath.Join(dir, "*.none")}).Run(cli)).To(Succeed())
+		Expect(cli.Flag).To(BeAnExistingFile())
+	})
+
+	It("should reject an invalid --glob", func() {
+		Expect((&CliStop{Glob: filepath.Join(dir, "[")}).Run(cli)).To(MatchError(ContainSubstring("invalid --glob")))
+	})
+})
+
+var _ = Describe("CliArm", func() {
+	var cli *Cli
+
+	BeforeEach(func() {
+		cli = &Cli{Flag: filepath.Join(GinkgoT().TempDir(), "gha-debug.flag")}
+	})
+
+	It("should create the flag file with our token", func() {
+		arm := &CliArm{FlagContent: "42"}
+		Expect(arm.Run(cli)).To(Succeed())
+		Expect(os.ReadFile(cli.Flag)).To(Equal([]byte("\n42\n")))
+	})
+
+	It("should leave an existing flag file alone", func() {
+		Expect(os.WriteFile(cli.Flag, []byte("existing"), 0644)).To(Succeed())
+		Expect((&CliArm{FlagContent: "42"}).Run(cli)).To(Succeed())
+		Expect(os.ReadFile(cli.Flag)).To(Equal([]byte("existing")))
+	})
+
+	It("should start a --no-create-flag transaction between start and stop", func() {
+		GinkgoT().Setenv("GITHUB_RUN_ID", "42")
+		start := &CliStart{
+			Repo:         "org/repo",
+			Backend:      "stdout",
+			Output:       filepath.Join(GinkgoT().TempDir(), "output.json"),
+			FlagContent:  "42",
+			NoCreateFlag: true,
+		}
+		start.SetGitHubActions(&fakeActions{})
+
+		// Start watches, without creating the flag file
+		done := make(chan error)
+		go func(start *CliStart, cli *Cli) {
+			done <- start.Run(cli)
+		}(start, cli)
+		Consistently(cli.Flag, 0.2).ShouldNot(BeAnExistingFile())
+
+		// Arm creates the flag, starting the transaction
+		Expect((&CliArm{FlagContent: "42"}).Run(cli)).To(Succeed())
+		Consistently(done, 0.2).ShouldNot(Receive())
+
+		// And stop ends it
+		Expect((&CliStop{}).Run(cli)).To(Succeed())
+		Eventually(done, 5).Should(Receive(BeNil()))
+
+		var record startRecord
+		data, err := os.ReadFile(start.Output)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(json.Unmarshal(data, &record)).To(Succeed())
+		Expect(record.Attributes).To(HaveKeyWithValue("start_source", Or(Equal("event"), Equal("poll"))))
+	})
+})
+
+var _ = Describe("CliEnv", func() {
+	It("should print the environment we read as JSON", func() {
+		GinkgoT().Setenv("GITHUB_REPOSITORY", "org/repo")
+		GinkgoT().Setenv("RUNNER_NAME", "runner-1")
+		GinkgoT().Setenv("GITHUB_JOB", "")
+
+		cli := &Cli{Flag: "/tmp/gha-debug.flag"}
+		out := captureStdout(func() {
+			Expect(cli.Env.Run(cli)).To(Succeed())
+		})
+
+		var printed struct {
+			Env  map[string]string `json:"env"`
+			Flag string            `json:"flag"`
+		}
+		Expect(json.Unmarshal([]byte(out), &printed)).To(Succeed())
+		Expect(printed.Flag).To(Equal("/tmp/gha-debug.flag"))
+		Expect(printed.Env).To(HaveKeyWithValue("GITHUB_REPOSITORY", "org/repo"))
+		Expect(printed.Env).To(HaveKeyWithValue("RUNNER_NAME", "runner-1"))
+		Expect(printed.Env).To(HaveKeyWithValue("GITHUB_JOB", ""))
+	})
+})
+
+var _ = Describe("CliFlagPath", func() {
+	// flagPath runs the flag-path command with args, returning what it printed
+	flagPath := func(args ...string) string {
+		cli := &Cli{}
+		Expect(cli.ParseArgs(append([]string{"flag-path"}, args...))).To(Succeed())
+		return captureStdout(func() {
+			Expect(cli.Main()).To(Succeed())
+		})
+	}
+
+	It("should resolve a relative flag against the workspace", func() {
+		workspace := GinkgoT().TempDir()
+		GinkgoT().Setenv("GITHUB_WORKSPACE", workspace)
+		Expect(flagPath("--flag", "flags/debug.flag")).To(Equal(filepath.Join(workspace, "flags", "debug.flag") + "\n"))
+	})
+
+	It("should use the default flag in the workspace", func() {
+		workspace := GinkgoT().TempDir()
+		GinkgoT().Setenv("GITHUB_WORKSPACE", workspace)
+		Expect(flagPath()).To(Equal(filepath.Join(workspace, "gha-debug.flag") + "\n"))
+	})
+
+	It("should leave an absolute flag alone", func() {
+		GinkgoT().Setenv("GITHUB_WORKSPACE", GinkgoT().TempDir())
+		Expect(flagPath("--flag", "/var/run/gha-debug.flag")).To(Equal("/var/run/gha-debug.flag\n"))
+	})
+
+	It("should expand the home directory", func() {
+		GinkgoT().Setenv("GITHUB_WORKSPACE", GinkgoT().TempDir())
+		Expect(flagPath("--flag", "~/gha-debug.flag")).To(Equal(kong.ExpandPath("~/gha-debug.flag") + "\n"))
+		Expect(kong.ExpandPath("~/gha-debug.flag")).ToNot(HavePrefix("~"))
+	})
+
+	It("should resolve against the working directory without a workspace", func() {
+		GinkgoT().Setenv("GITHUB_WORKSPACE", "")
+		wd, err := os.Getwd()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(flagPath("--flag", "gha-debug.flag")).To(Equal(filepath.Join(wd, "gha-debug.flag") + "\n"))
+	})
+
+	It("should print the path stop removes", func() {
+		GinkgoT().Setenv("GITHUB_WORKSPACE", GinkgoT().TempDir())
+		path := strings.TrimSpace(flagPath("--flag", "rel.flag"))
+		Expect(os.WriteFile(path, []byte("\n"), 0644)).To(Succeed())
+
+		cli := &Cli{}
+		Expect(cli.ParseArgs([]string{"stop", "--flag", "rel.flag"})).To(Succeed())
+		Expect(cli.Main()).To(Succeed())
+		Expect(path).ToNot(BeAnExistingFile())
+	})
+})
+
+var _ = Describe("CliWatch", func() {
+	var cli *Cli
+	var out *lockedBuffer
+	var done chan error
+
+	// stages returns the stages printed so far, without their timestamps
+	stages := func() (stages []string) {
+		for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) < 2 {
+				continue
+			}
+			_, err := time.Parse(time.RFC3339Nano, fields[0])
+			Expect(err).ToNot(HaveOccurred(), line)
+			stages = append(stages, strings.Join(fields[1:], " "))
+		}
+		return
+	}
+
+	BeforeEach(func() {
+		cli = &Cli{Flag: filepath.Join(GinkgoT().TempDir(), "gha-debug.flag")}
+		out = &lockedBuffer{}
+		cli.Watch.SetOutput(out)
+		done = make(chan error, 1)
+	})
+
+	// watchInBackground runs the watch command until it's watching
+	watchInBackground := func() {
+		cli, done := cli, done
+		go func() {
+			done <- cli.Watch.Run(cli)
+		}()
+		Eventually(stages).Should(ContainElement("watching " + cli.Flag))
+	}
+
+	It("should print each stage of a create and remove cycle", func() {
+		watchInBackground()
+		Consistently(done, 0.1).ShouldNot(Receive())
+
+		Expect(os.WriteFile(cli.Flag, nil, 0644)).To(Succeed())
+		Eventually(stages).Should(ContainElement("started"))
+		Expect(os.Remove(cli.Flag)).To(Succeed())
+
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(stages()).To(Equal([]string{"watching " + cli.Flag, "started", "released", "done"}))
+	})
+
+	It("should say when it resumed an existing flag", func() {
+		Expect(os.WriteFile(cli.Flag, nil, 0644)).To(Succeed())
+		watchInBackground()
+		Eventually(stages).Should(ContainElement("started resumed"))
+		Expect(os.Remove(cli.Flag)).To(Succeed())
+		Eventually(done).Should(Receive(BeNil()))
+	})
+})
+
+var _ = Describe("CliCheck", func() {
+	var cli *Cli
+	var server *httptest.Server
+	var rateStatus int
+
+	// checkReport is what the check command prints
+	type checkReport struct {
+		OK     bool `json:"ok"`
+		Checks []struct {
+			Name  string `json:"name"`
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		} `json:"checks"`
+	}
+
+	// runCheck runs the check command, returning its error and report
+	runCheck := func() (report checkReport, err error) {
+		out := captureStdout(func() {
+			err = cli.Check.Run(cli)
+		})
+		Expect(json.Unmarshal([]byte(out), &report)).To(Succeed())
+		return
+	}
+
+	// result returns whether the named check passed
+	result := func(report checkReport, name string) (ok bool, errText string) {
+		for _, check := range report.Checks {
+			if check.Name == name {
+				return check.OK, check.Error
+			}
+		}
+		Fail("no result for check " + name)
+		return
+	}
+
+	BeforeEach(func() {
+		rateStatus = http.StatusOK
+		mux := http.NewServeMux()
+		mux.HandleFunc("/rate_limit", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(rateStatus)
+			fmt.Fprint(w, `{"resources": {"core": {"limit": 5000, "remaining": 4999}}}`)
+		})
+		var client *github.Client
+		server, client = stubGitHub(mux)
+		DeferCleanup(server.Close)
+
+		cli = &Cli{Flag: filepath.Join(GinkgoT().TempDir(), "nested", "gha-debug.flag")}
+		cli.Check.Backend = "stdout"
+		cli.Check.Output = filepath.Join(GinkgoT().TempDir(), "output.json")
+		cli.Check.SetGitHubClient(client)
+	})
+
+	It("should pass every check when everything works", func() {
+		report, err := runCheck()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(report.OK).To(BeTrue())
+		Expect(report.Checks).To(HaveLen(4))
+		for _, check := range report.Checks {
+			Expect(check.OK).To(BeTrue(), check.Name)
+		}
+		// Nothing is left behind in the flag directory
+		entries, err := os.ReadDir(filepath.Dir(cli.Flag))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(entries).To(BeEmpty())
+	})
+
+	It("should fail when the flag directory isn't writable", func() {
+		if os.Getuid() == 0 {
+			Skip("root can write anywhere")
+		}
+		dir := filepath.Dir(cli.Flag)
+		Expect(os.MkdirAll(dir, 0755)).To(Succeed())
+		Expect(os.Chmod(dir, 0555)).To(Succeed())
+		DeferCleanup(os.Chmod, dir, os.FileMode(0755))
+
+		report, err := runCheck()
+		Expect(err).To(MatchError("1 of 4 checks failed"))
+		Expect(report.OK).To(BeFalse())
+		ok, errText := result(report, "flag_dir_writable")
+		Expect(ok).To(BeFalse())
+		Expect(errText).To(ContainSubstring("permission denied"))
+	})
+
+	It("should fail when the flag directory can't be created", func() {
+		parent := GinkgoT().TempDir()
+		Expect(os.WriteFile(filepath.Join(parent, "file"), nil, 0644)).To(Succeed())
+		cli.Flag = filepath.Join(parent, "file", "gha-debug.flag")
+
+		report, err := runCheck()
+		Expect(err).To(HaveOccurred())
+		ok, _ := result(report, "flag_dir_writable")
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should fail when GitHub rejects the credentials", func() {
+		rateStatus = http.StatusUnauthorized
+
+		report, err := runCheck()
+		Expect(err).To(MatchError("1 of 4 checks failed"))
+		ok, errText := result(report, "github")
+		Expect(ok).To(BeFalse())
+		Expect(errText).To(ContainSubstring("401"))
+	})
+
+	It("should fail when there are no GitHub credentials", func() {
+		cli.Check.SetGitHubClient(nil)
+
+		report, _ := runCheck()
+		ok, _ := result(report, "github")
+		Expect(ok).To(BeFalse())
+	})
+})
+
+// BenchmarkGitHubJobStatusLargeJob resolves the status of a job with hundreds
+// of steps, with a span recorded for each of them.
+func BenchmarkGitHubJobStatusLargeJob(b *testing.B) {
+	b.Setenv("RUNNER_NAME", "runner-1")
+	b.Setenv("GITHUB_RUN_ID", "42")
+	b.Setenv("GITHUB_RUN_ATTEMPT", "")
+	start := &CliStart{Repo: "org/repo"}
+	start.SetGitHubActions(&fakeActions{jobs: []*github.WorkflowJob{largeJob(1000, 900)}})
+	log.SetLevel(log.WarnLevel)
+	defer log.SetLevel(log.InfoLevel)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, err := start.GitHubJobStatus(newFakeTxn())
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
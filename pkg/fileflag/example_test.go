@@ -0,0 +1,56 @@
+package fileflag_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/shakefu/gha-debug/pkg/fileflag"
+)
+
+// Two goroutines coordinate through a flag file, as two processes would. The
+// holder creates the file to acquire the latch and releases it when it's
+// finished, while the waiter blocks until then.
+func Example() {
+	dir, err := os.MkdirTemp("", "fileflag-example-*")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "latch")
+
+	latch, err := fileflag.New(path, fileflag.FileFlagOptions{})
+	if err != nil {
+		panic(err)
+	}
+	defer latch.Close()
+
+	holding := make(chan struct{})
+	finished := make(chan struct{})
+	go func() {
+		// Any process can acquire the latch by creating the file
+		err := os.WriteFile(path, nil, 0644)
+		if err != nil {
+			panic(err)
+		}
+		close(holding)
+		<-finished
+		fmt.Println("holder: releasing")
+		err = latch.Release()
+		if err != nil {
+			panic(err)
+		}
+	}()
+
+	<-holding
+	latch.Acquire()
+	fmt.Println("waiter: latch is held")
+	close(finished)
+	latch.Wait()
+	fmt.Println("waiter: latch was released")
+
+	// Output:
+	// waiter: latch is held
+	// holder: releasing
+	// waiter: latch was released
+}
@@ -0,0 +1,37 @@
+package fileflag
+
+import (
+	"os"
+	"time"
+)
+
+// SetWatchSetupHook sets a function to run in Watch between the initial check
+// for the file and signalling that we're watching, until restore is called.
+func SetWatchSetupHook(hook func()) (restore func()) {
+	testHookWatchSetup = hook
+	return func() {
+		testHookWatchSetup = func() {}
+	}
+}
+
+// SetStat replaces how the flag file is stat'd, before Watch is called, so
+// tests can script whether it exists.
+func (ff *FileFlag) SetStat(stat func(name string) (os.FileInfo, error)) {
+	ff.statFunc = stat
+}
+
+// SetStatTimeout sets how long a probe of the flag file runs before we warn
+// it's slow, before Watch is called.
+func (ff *FileFlag) SetStatTimeout(timeout time.Duration) {
+	ff.statTimeout = timeout
+}
+
+// SetNewWatcher replaces how FileFlags create their Watcher, and the delay
+// before retrying, until restore is called.
+func SetNewWatcher(factory func() (Watcher, error), delay time.Duration) (restore func()) {
+	original, originalDelay := newWatcher, watchRetryDelay
+	newWatcher, watchRetryDelay = factory, delay
+	return func() {
+		newWatcher, watchRetryDelay = original, originalDelay
+	}
+}
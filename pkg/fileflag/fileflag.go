@@ -1,10 +1,17 @@
-// Package fileflag provides the FileFlag type, which lets you use asynchronous flags for interprocess semaphore.
+// Package fileflag provides the FileFlag type, which lets you use asynchronous
+// flags for interprocess semaphore. See New for using a FileFlag as a named
+// latch between processes.
 package fileflag
 
 import (
+	"context"
 	"errors"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/charmbracelet/log"
@@ -14,24 +21,203 @@ import (
 
 type FileFlag struct {
 	filename string
-	lock     *softlock.SoftLock
-	watcher  *fsnotify.Watcher
-	watching chan struct{}
+	token    string
+	lock     atomic.Pointer[softlock.SoftLock] // lock is replaced for each cycle by WaitN
+	running  sync.Mutex                        // running is held by Watch, so only one handles events
+
+	staleAfter time.Duration // staleAfter is how long we can go without activity
+	lastActive time.Time     // lastActive is only used by the Watch goroutine
+	pollWarned bool          // pollWarned is only used by the Watch goroutine
+
+	statFunc    func(name string) (os.FileInfo, error) // statFunc stats our file, os.Stat outside of tests
+	statTimeout time.Duration                          // statTimeout is how long a probe runs before we warn
+	pending     chan probeResult                       // pending is the probe in flight, only used by Watch
+	probeSince  time.Time                              // probeSince is when the pending probe started
+	probeWarned bool                                   // probeWarned is set once the pending probe is slow
+	reprobe     string                                 // reprobe is the source to probe again for, once pending is done
+
+	watcher    Watcher
+	pollOnly   bool   // pollOnly is set when we only poll, with no events
+	watchedDir string // watchedDir is the ancestor we watch until our directory exists
+
+	startOnTouch bool      // startOnTouch is set to start on mtime changes
+	baseline     time.Time // baseline is the mtime before we watched
+	watching     chan struct{}
+	closed       bool       // closed is set once Close has been called
+	resumed      bool       // resumed is set if the flag existed before watching
+	startSource  string     // startSource is what started the lock
+	cycles       int        // cycles counts the create/remove cycles WaitN has armed
+	m            sync.Mutex // m protects closing the watching channel and our flags
+}
+
+// FileFlagOptions configures optional FileFlag behavior.
+type FileFlagOptions struct {
+	// Watcher to use for file events, defaults to a new fsnotify.Watcher. Use
+	// WatcherPool.Watcher to share one between many flags.
+	Watcher Watcher
+	// Token which must be in the flag file's content for it to count as our
+	// flag, so stale files from other processes aren't matched
+	Token string
+	// StaleAfter releases the flag if it hasn't been written or touched for
+	// this long after starting, so abandoned flags don't wait forever. Zero
+	// disables it.
+	StaleAfter time.Duration
+	// PollOnly skips file events entirely, relying on polling the file, for
+	// filesystems where events aren't delivered reliably. It overrides
+	// Watcher.
+	PollOnly bool
+	// StartOnTouch starts the lock when the file's modification time changes
+	// after we start watching, instead of when it's created, for flag files
+	// which are kept around and touched. A file which already exists isn't
+	// resumed.
+	StartOnTouch bool
+	// WatchMissingDir watches the nearest existing ancestor of the flag
+	// file's directory when it doesn't exist yet, moving the watch down as
+	// each directory is created, instead of failing. This doesn't work with
+	// WatcherPool's Watchers, which only watch one directory, so they fall
+	// back to polling.
+	WatchMissingDir bool
+	// WatchAttempts is how many times to try creating the watcher, and
+	// watching the flag file's directory, when the process is briefly out of
+	// open files or inotify instances or watches. Other errors aren't retried.
+	// Defaults to 3.
+	WatchAttempts int
+}
+
+// defaultWatchAttempts is how many times we try to watch, unless configured
+const defaultWatchAttempts = 3
+
+// watchRetryDelay is how long we wait before retrying a watch, doubling each
+// time.
+var watchRetryDelay = 100 * time.Millisecond
+
+// newWatcher creates the Watcher for a FileFlag which wasn't given one.
+var newWatcher = func() (Watcher, error) {
+	fw, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	return &fsWatcher{w: fw}, nil
+}
+
+// Watcher is the subset of fsnotify.Watcher used by FileFlag. It exists so
+// tests can inject synthetic events without touching the filesystem.
+type Watcher interface {
+	Add(name string) error
+	Close() error
+	Events() <-chan fsnotify.Event
+	Errors() <-chan error
+}
+
+// fsWatcher adapts a fsnotify.Watcher to the Watcher interface.
+type fsWatcher struct {
+	w *fsnotify.Watcher
+}
+
+func (fw *fsWatcher) Add(name string) error         { return fw.w.Add(name) }
+func (fw *fsWatcher) Close() error                  { return fw.w.Close() }
+func (fw *fsWatcher) Events() <-chan fsnotify.Event { return fw.w.Events }
+func (fw *fsWatcher) Errors() <-chan error          { return fw.w.Errors }
+
+// pollStatTimeout is how long a probe of the flag file can take before we warn
+// that it's hung, e.g. on a wedged network mount.
+const pollStatTimeout = 2 * time.Second
+
+// probeResult is the outcome of probing the flag file in the background.
+type probeResult struct {
+	info    os.FileInfo
+	err     error
+	matches bool   // matches is whether the file has our token, if it exists
+	source  string // source is what asked for the probe, for StartSource
+}
+
+// pollWatcher is a Watcher which never has any events, for PollOnly.
+type pollWatcher struct {
+	events chan fsnotify.Event
+	errors chan error
+	once   sync.Once
+}
+
+func newPollWatcher() *pollWatcher {
+	return &pollWatcher{
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+	}
+}
+
+func (pw *pollWatcher) Add(name string) error { return nil }
+
+// Close closes our channels, which stops Watch like closing a real watcher
+func (pw *pollWatcher) Close() error {
+	pw.once.Do(func() {
+		close(pw.events)
+		close(pw.errors)
+	})
+	return nil
 }
 
+func (pw *pollWatcher) Events() <-chan fsnotify.Event { return pw.events }
+func (pw *pollWatcher) Errors() <-chan error          { return pw.errors }
+
 // NewFileFlag creates a new FileFlag.
 func NewFileFlag(filename string) (ff *FileFlag, err error) {
-	// Create our watcher first
-	watcher, err := fsnotify.NewWatcher()
-	if err != nil {
-		return
+	return NewFileFlagWithOptions(filename, FileFlagOptions{})
+}
+
+// NewFileFlagWithWatcher creates a new FileFlag using the given Watcher rather
+// than creating a fsnotify.Watcher.
+func NewFileFlagWithWatcher(filename string, watcher Watcher) (ff *FileFlag, err error) {
+	return NewFileFlagWithOptions(filename, FileFlagOptions{Watcher: watcher})
+}
+
+// NewFileFlagWithOptions creates a new FileFlag configured by opts.
+func NewFileFlagWithOptions(filename string, opts FileFlagOptions) (ff *FileFlag, err error) {
+	attempts := opts.WatchAttempts
+	if attempts <= 0 {
+		attempts = defaultWatchAttempts
+	}
+
+	// Create our watcher first, if we weren't given one
+	watcher := opts.Watcher
+	if opts.PollOnly {
+		watcher = newPollWatcher()
+	} else if watcher == nil {
+		err = retryWatch(attempts, func() (err error) {
+			watcher, err = newWatcher()
+			return
+		})
+		if err != nil {
+			return
+		}
+		defer func() {
+			// Don't leak the watcher if we couldn't use it
+			if err != nil {
+				watcher.Close()
+			}
+		}()
 	}
 
 	// Can't watch for non-existent files, so we watch directories instead
 	path := filepath.Dir(filename)
 
+	// Or the nearest directory which does exist, if we're allowed to wait for
+	// ours to be created
+	var watchedDir string
+	if opts.WatchMissingDir {
+		watchedDir, err = existingAncestor(path)
+		if err != nil {
+			return
+		}
+		if watchedDir != path {
+			log.Debug("Flag directory is missing, watching an ancestor", "dir", path, "ancestor", watchedDir)
+		}
+		path = watchedDir
+	}
+
 	// Watch the directory which will contain, eventually, our target file
-	err = watcher.Add(path)
+	err = retryWatch(attempts, func() error {
+		return watcher.Add(path)
+	})
 	if err != nil {
 		return
 	}
@@ -39,118 +225,522 @@ func NewFileFlag(filename string) (ff *FileFlag, err error) {
 	// Create a new instance and return it
 	ff = &FileFlag{
 		filename: filename,
-		lock:     softlock.NewSoftLock(),
-		watcher:  watcher,
-		watching: make(chan struct{}),
+		token:    opts.Token,
+
+		staleAfter:  opts.StaleAfter,
+		statFunc:    os.Stat,
+		statTimeout: pollStatTimeout,
+		watcher:     watcher,
+		pollOnly:    opts.PollOnly,
+		watchedDir:  watchedDir,
+
+		startOnTouch: opts.StartOnTouch,
+		watching:     make(chan struct{}),
 	}
+	ff.lock.Store(softlock.NewSoftLock())
 
 	return
 }
 
+// retryWatch calls watch until it succeeds, fails with an error which isn't
+// resource pressure, or has been tried attempts times, backing off between
+// tries. It returns the last error.
+func retryWatch(attempts int, watch func() error) (err error) {
+	delay := watchRetryDelay
+	for attempt := 1; ; attempt++ {
+		err = watch()
+		if err == nil || attempt >= attempts || !outOfWatchResources(err) {
+			return
+		}
+		log.Debug("Could not watch, retrying", "attempt", attempt, "delay", delay, "err", err)
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// outOfWatchResources returns true if err is from running out of open files,
+// inotify instances or inotify watches, which other processes may free up.
+func outOfWatchResources(err error) bool {
+	return errors.Is(err, syscall.EMFILE) || errors.Is(err, syscall.ENFILE) || errors.Is(err, syscall.ENOSPC)
+}
+
+// testHookWatchSetup runs in Watch between the initial check for the file and
+// signalling that we're watching, so tests can land in that window.
+var testHookWatchSetup = func() {}
+
 // Watch is our goroutine for watching for changes.
+//
+// The sequencing on startup is: the directory is already watched by the
+// constructor, so events are queued from then on; we check whether the file
+// already exists; we signal WaitForWatch; then we check again before reading
+// events. The second check catches a file created around the first one, which
+// an injected or lagging watcher may never report, without waiting a poll
+// interval.
 func (ff *FileFlag) Watch() {
+	// WaitN starts a Watch for each cycle, which mustn't handle events until
+	// the last cycle's is done
+	ff.running.Lock()
+	defer ff.running.Unlock()
+
+	// Make sure nothing waits forever for us to start watching if we bail
+	defer ff.signalWatching()
+
 	// If the file exists, start the lock
-	if _, err := os.Stat(ff.filename); errors.Is(err, os.ErrNotExist) {
+	if info, err := ff.statFunc(ff.filename); errors.Is(err, os.ErrNotExist) {
 		// Doesn't exist, we're good
 	} else if err != nil {
 		// Something else happened
 		log.Error("Error", "err", err)
 		return
-	} else {
-		// It exists, start the lock
-		ff.lock.Start()
+	} else if ff.startOnTouch {
+		// It exists, but we only start once it's touched again
+		ff.baseline = info.ModTime()
+	} else if ff.matches() {
+		// It exists, so we're resuming a flag from before we started watching,
+		// e.g. after a crash and restart
+		ff.start(startExisting)
+		ff.m.Lock()
+		ff.resumed = true
+		ff.m.Unlock()
 	}
 
+	testHookWatchSetup()
+
 	// Signal that we've started watching for the file flag
-	select {
-	case <-ff.watching:
-		// Already started, do nothing
-	default:
-		// Close our semaphore channel
-		close(ff.watching)
+	ff.signalWatching()
+
+	// Check again, in case the file was created while we were setting up
+	if !ff.cycle().Started() {
+		ff.probe(startCheck)
 	}
 
 	for {
 		// Explicit yield to the scheduler, so we don't hang?
 		// runtime.Gosched()
 		select {
-		case event, ok := <-ff.watcher.Events:
+		case event, ok := <-ff.watcher.Events():
 			// If there's nothing on the channel, keep going
 			if !ok {
 				return
 			}
+			log.Debug("Watcher event", "name", event.Name, "op", event.Op)
+
+			// If a directory on the way to ours was created, watch closer
+			if event.Has(fsnotify.Create) && ff.waitingForDir(event.Name) {
+				ff.watchCloser()
+				continue
+			}
 
 			// If the event isn't for our file, keep going
 			if event.Name != ff.filename {
 				continue
 			}
 
-			// If the event is our file being created, start the lock
-			if event.Has(fsnotify.Create) {
-				ff.lock.Start()
+			// Permission changes, e.g. from antivirus or backup tools, mean
+			// nothing to us unless touches are what start us
+			if event.Op == fsnotify.Chmod && !ff.startOnTouch {
+				log.Debug("Ignoring Chmod event", "name", event.Name)
+				continue
+			}
+
+			// If the event is our file being created, start the lock. We also
+			// check writes, since the token may not be written yet on create,
+			// and touches when they're what starts us
+			if event.Has(fsnotify.Create) || event.Has(fsnotify.Write) || (ff.startOnTouch && event.Has(fsnotify.Chmod)) {
+				if ff.token == "" && !ff.startOnTouch {
+					ff.start(startEvent)
+				} else {
+					// Reading the token or mtime could hang, so we probe
+					ff.probe(startEvent)
+				}
+				// Writes also keep the flag alive
+				ff.lastActive = time.Now()
 				continue
 			}
 
-			// If the event is our file being removed, release the lock
-			if event.Has(fsnotify.Remove) {
-				ff.lock.Release()
+			// If the event is our file being removed, release the lock. A
+			// stale file being removed before we start doesn't count
+			if event.Has(fsnotify.Remove) && ff.cycle().Started() {
+				ff.cycle().Release()
 				return
 			}
-		case err, ok := <-ff.watcher.Errors:
-			if !ok {
-				log.Error("Watcher error", "err", err)
+
+			// Renaming our file away removes it too, but atomic rewrites
+			// rename a new file into place over ours, so we probe the path
+			// rather than following the old file, which releases us if
+			// nothing replaced it
+			if event.Has(fsnotify.Rename) && ff.cycle().Started() {
+				ff.probe(startEvent)
+			}
+		case result := <-ff.pending:
+			// A nil pending blocks, so this is only a probe we started
+			ff.pending = nil
+			if ff.probed(result) {
 				return
 			}
-			defer ff.Close()
-			log.Fatal("Error", "err", err)
+			if ff.reprobe != "" {
+				source := ff.reprobe
+				ff.reprobe = ""
+				ff.probe(source)
+			}
+		case err, ok := <-ff.watcher.Errors():
+			// Either way we can't trust the watcher any more. Closing releases
+			// anything waiting on us, so callers get to clean up, where
+			// exiting the process wouldn't let them
+			log.Error("Watcher error", "err", err)
+			if ok {
+				defer ff.Close()
+			}
+			return
 		case <-time.After(200 * time.Millisecond):
 			// This timeout implements a pollling behavior (yuck), with a 200ms
 			// interval as a back-up for the watcher. If there's a long running
 			// task, this will be harmlessly invoked manually checking the file,
-			// which won't exist
-			//
-			// This can also happen if the file is created while we're setting
-			// up the watcher - the file creation event will be lost, and the
-			// lock will never be started. This is a workaround for that.
-			if !ff.lock.Started() {
+			// which won't exist. A slow start isn't worth more than one warning
+			if !ff.cycle().Started() && !ff.pollOnly && !ff.pollWarned {
 				log.Warn("FileFlag timeout, use FileFlag.WaitForWatch()", "filename", ff.filename)
+				ff.pollWarned = true
 			}
-			// We've been hanging out in this too long, let's check our lock manually
-			_, err := os.Stat(ff.filename)
-			if err == nil {
-				// File exists, start the lock
-				ff.lock.Start()
-				continue
-			} else if os.IsNotExist(err) {
-				// File does not exist, release the lock, if it was already started
-				if ff.lock.Started() {
-					ff.lock.Release()
-					return
-				}
-			} else {
-				// Some other error, log it and bail
-				log.Error("Error", "err", err)
-				return
+			// We've been hanging out in this too long, let's check our lock
+			// manually. The probe runs in the background, so a hung stat
+			// only delays this, not handling events
+			if ff.pending == nil {
+				ff.probe(startPoll)
+			} else if !ff.probeWarned && time.Since(ff.probeSince) > ff.statTimeout {
+				log.Warn("Polling the flag file is taking too long, still waiting", "filename", ff.filename, "timeout", ff.statTimeout)
+				ff.probeWarned = true
 			}
 		}
 	}
 }
 
+// probe checks the flag file in the background, stat'ing it and reading its
+// token, and sends the result to pending for Watch to handle with probed. Only
+// one probe is ever in flight, so a hung mount doesn't pile up goroutines;
+// asking again while one is in flight probes again once it's done, since it
+// may have missed what we're asking about. It's only called by the Watch
+// goroutine.
+func (ff *FileFlag) probe(source string) {
+	if ff.pending != nil {
+		ff.reprobe = source
+		return
+	}
+	ff.pending = make(chan probeResult, 1)
+	ff.probeSince = time.Now()
+	ff.probeWarned = false
+	go func(pending chan<- probeResult, stat func(string) (os.FileInfo, error)) {
+		result := probeResult{source: source}
+		result.info, result.err = stat(ff.filename)
+		if result.err == nil {
+			result.matches = ff.matches()
+		}
+		pending <- result
+	}(ff.pending, ff.statFunc)
+}
+
+// probed handles a probe's result, starting the lock if the file is ours, or
+// releasing it if the file is gone or stale. It returns true if Watch is done.
+func (ff *FileFlag) probed(result probeResult) (done bool) {
+	log.Debug("Polled flag", "filename", ff.filename, "source", result.source, "exists", result.err == nil)
+	switch {
+	case result.err == nil:
+		// File exists, start the lock if it's ours
+		modTime := result.info.ModTime()
+		if result.matches && (!ff.startOnTouch || modTime.After(ff.baseline)) {
+			ff.start(result.source)
+		}
+		// Touching the file keeps it alive, otherwise it's abandoned
+		if modTime.After(ff.lastActive) {
+			ff.lastActive = modTime
+		}
+		if ff.stale() {
+			log.Warn("FileFlag is stale, releasing", "filename", ff.filename, "lastActive", ff.lastActive)
+			ff.cycle().Release()
+			return true
+		}
+	case errors.Is(result.err, os.ErrNotExist):
+		// File does not exist, release the lock, if it was already started
+		if ff.cycle().Started() {
+			ff.cycle().Release()
+			return true
+		}
+	default:
+		// Some other error, log it and bail
+		log.Error("Error", "err", result.err)
+		return true
+	}
+	return false
+}
+
+// existingAncestor returns dir if it exists, otherwise its nearest ancestor
+// which does.
+func existingAncestor(dir string) (ancestor string, err error) {
+	ancestor = dir
+	for {
+		_, err = os.Stat(ancestor)
+		if !errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		parent := filepath.Dir(ancestor)
+		if parent == ancestor {
+			return
+		}
+		ancestor = parent
+	}
+}
+
+// waitingForDir returns true if we're watching an ancestor of our directory,
+// and name is our directory or one of the directories between them.
+func (ff *FileFlag) waitingForDir(name string) bool {
+	dir := filepath.Dir(ff.filename)
+	if ff.watchedDir == "" || ff.watchedDir == dir {
+		return false
+	}
+	return name == dir || strings.HasPrefix(dir, name+string(filepath.Separator))
+}
+
+// watchCloser moves our watch to the nearest existing ancestor of our
+// directory, or the directory itself. The ancestor stays watched too, since
+// Watchers can't remove directories, but its other events are ignored.
+func (ff *FileFlag) watchCloser() {
+	dir, err := existingAncestor(filepath.Dir(ff.filename))
+	if err != nil {
+		log.Error("Error", "err", err)
+		return
+	}
+	if dir == ff.watchedDir {
+		return
+	}
+	err = ff.watcher.Add(dir)
+	if err != nil {
+		// Polling still finds the file, just not as quickly
+		log.Warn("Could not watch flag directory, polling instead", "dir", dir, "err", err)
+		ff.watchedDir = ""
+		return
+	}
+	log.Debug("Watching closer to the flag file", "dir", dir)
+	ff.watchedDir = dir
+
+	// The file may have been created before we were watching for it
+	if !ff.cycle().Started() {
+		ff.probe(startCheck)
+	}
+}
+
+// What started the lock, as returned by StartSource
+const (
+	startExisting = "existing" // the file existed before we watched it
+	startCheck    = "check"    // a check found the file while we set up a watch
+	startEvent    = "event"    // a file event
+	startPoll     = "poll"     // polling found a file we had no event for
+)
+
+// start starts the lock from source, tracking when we started for staleness.
+// It's only called by the Watch goroutine, so nothing else can start the lock
+// between checking and starting it, except Close.
+func (ff *FileFlag) start(source string) {
+	if ff.cycle().Started() {
+		return
+	}
+	// Record the source first, so it's there once anyone sees we started
+	ff.m.Lock()
+	ff.startSource = source
+	ff.m.Unlock()
+	if ff.cycle().Start() {
+		ff.lastActive = time.Now()
+	}
+}
+
+// StartSource returns what started the flag: "event" for a file event, "poll"
+// for polling which found a file we had no event for, "existing" for a file
+// which existed before we watched, or "check" for a file created while we set
+// up a watch. It's empty if the flag hasn't started, or was only closed.
+func (ff *FileFlag) StartSource() string {
+	ff.m.Lock()
+	defer ff.m.Unlock()
+	if !ff.cycle().Started() {
+		return ""
+	}
+	return ff.startSource
+}
+
+// stale returns true if the flag has started and hasn't been written or
+// touched within our StaleAfter timeout.
+func (ff *FileFlag) stale() bool {
+	if ff.staleAfter <= 0 || !ff.cycle().Started() {
+		return false
+	}
+	return time.Since(ff.lastActive) > ff.staleAfter
+}
+
+// Resumed returns true if the flag file already existed when we started
+// watching, rather than being created while we watched.
+func (ff *FileFlag) Resumed() bool {
+	ff.m.Lock()
+	defer ff.m.Unlock()
+	return ff.resumed
+}
+
+// Exists returns true if the flag file currently exists, with errors other
+// than it not existing treated as existing, like Check.
+func (ff *FileFlag) Exists() bool {
+	_, err := ff.statFunc(ff.filename)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// ModTime returns the flag file's modification time, or the zero time if it
+// doesn't exist.
+func (ff *FileFlag) ModTime() time.Time {
+	info, err := ff.statFunc(ff.filename)
+	if err != nil {
+		return time.Time{}
+	}
+	return info.ModTime()
+}
+
+// Check returns true if the flag file at filename currently exists, without
+// needing a FileFlag. Errors other than the file not existing are treated as
+// existing, so callers acting on the file will see the real error.
+func Check(filename string) bool {
+	_, err := os.Stat(filename)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// matches returns true if the flag file contains our token, or if we don't
+// have a token.
+func (ff *FileFlag) matches() bool {
+	if ff.token == "" {
+		return true
+	}
+	return HasToken(ff.filename, ff.token)
+}
+
+// HasToken returns true if the flag file at filename contains token as one of
+// its whitespace separated fields.
+func HasToken(filename, token string) bool {
+	content, err := os.ReadFile(filename)
+	if err != nil {
+		return false
+	}
+	for _, field := range strings.Fields(string(content)) {
+		if field == token {
+			return true
+		}
+	}
+	return false
+}
+
 // WaitForStart blocks until the flag exists. If it already exists, it is a
 // passthrough.
 func (ff *FileFlag) WaitForStart() {
 	ff.WaitForWatch()
-	if ff.lock.Started() {
+	if ff.cycle().Started() {
 		return
 	}
-	ff.lock.WaitForStart()
+	ff.cycle().WaitForStart()
 }
 
-// Wait blocks until the flag has been removed. If the flag is already removed,
-// it is a passthrough.
+// Wait blocks until the flag has been removed, or the FileFlag is closed. If
+// the flag is already removed, it is a passthrough.
 func (ff *FileFlag) Wait() {
-	ff.WaitForStart()
-	ff.lock.Wait()
+	ff.cycle().BlockingWait()
+}
+
+// WaitN blocks until the flag has been created and removed n times, or the
+// FileFlag is closed, for sessions where the flag comes and goes, e.g. once per
+// debug iteration. Only cycles from now count: if the flag has already been
+// removed, it's re-armed first.
+//
+// Each time the flag is removed, WaitN re-arms it with a fresh lock and starts
+// a new Watch for the next cycle, so Wait, WaitForStart and StartSource follow
+// the latest cycle. There's no Rearm to call between cycles, WaitN does it. A
+// file created while re-arming is still found, but one created and removed
+// again before the next Watch is running is missed. Re-arming finishes the last
+// cycle's lock, so Done and WaitForDone from a cycle return once it re-arms.
+func (ff *FileFlag) WaitN(n int) {
+	if n <= 0 {
+		return
+	}
+	if ff.cycle().Released() && !ff.rearm() {
+		return
+	}
+	for i := 1; i < n; i++ {
+		ff.Wait()
+		if !ff.rearm() {
+			return
+		}
+	}
+	ff.Wait()
+}
+
+// Cycle returns which create/remove cycle the flag is on, counting from 1. It
+// only goes up when WaitN re-arms the flag.
+func (ff *FileFlag) Cycle() int {
+	ff.m.Lock()
+	defer ff.m.Unlock()
+	return ff.cycles + 1
+}
+
+// cycle returns the lock for the current create/remove cycle.
+func (ff *FileFlag) cycle() *softlock.SoftLock {
+	return ff.lock.Load()
+}
+
+// rearm replaces the released lock with a fresh one and starts watching for
+// the next cycle. It returns false, doing nothing, once we're closed, which
+// Close checks under the same mutex so it always closes the latest lock.
+func (ff *FileFlag) rearm() bool {
+	ff.m.Lock()
+	if ff.closed {
+		ff.m.Unlock()
+		return false
+	}
+	last := ff.cycle()
+	ff.lock.Store(softlock.NewSoftLock())
+	ff.startSource = ""
+	ff.cycles++
+	ff.m.Unlock()
+
+	last.Done()
+	go ff.Watch()
+	return true
+}
+
+// WaitContext blocks until the flag has been removed, as with Wait, or until
+// ctx is done, returning ctx.Err().
+func (ff *FileFlag) WaitContext(ctx context.Context) error {
+	return WaitAllContext(ctx, ff)
+}
+
+// WaitAll blocks until every flag has been removed, as with Wait.
+func WaitAll(flags ...*FileFlag) {
+	var wg sync.WaitGroup
+	wg.Add(len(flags))
+	for _, ff := range flags {
+		go func(ff *FileFlag) {
+			defer wg.Done()
+			ff.Wait()
+		}(ff)
+	}
+	wg.Wait()
+}
+
+// WaitAllContext blocks until every flag has been removed, as with Wait, or
+// until ctx is done, returning ctx.Err(). Flags are still waited on in the
+// background after ctx is done, until they're removed or closed.
+func WaitAllContext(ctx context.Context, flags ...*FileFlag) error {
+	done := make(chan struct{})
+	go func() {
+		WaitAll(flags...)
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 // WaitForWatch blocks until the flag has been watched.
@@ -165,22 +755,61 @@ func (ff *FileFlag) WaitForWatch() {
 
 // WaitForDone blocks until the flag has completely been resolved.
 func (ff *FileFlag) WaitForDone() {
-	ff.lock.WaitForDone()
+	ff.cycle().WaitForDone()
 }
 
-// Close closes the FileFlag and disables its watcher. This will also release
-// all waits. This method is nil-safe.
-func (ff *FileFlag) Close() {
-	if ff == nil {
-		return
-	}
-	// We wait for watching
+// WaitForDoneContext blocks until the flag has completely been resolved, as
+// with WaitForDone, or until ctx is done, returning ctx.Err().
+func (ff *FileFlag) WaitForDoneContext(ctx context.Context) error {
+	return ff.cycle().WaitForDoneContext(ctx)
+}
+
+// Done returns a channel which is closed once the flag has completely been
+// resolved, as WaitForDone would return, for use in a select. That's once the
+// FileFlag is closed.
+func (ff *FileFlag) Done() <-chan interface{} {
+	return ff.cycle().DoneChan()
+}
+
+// signalWatching closes our watching channel, if it isn't already closed.
+func (ff *FileFlag) signalWatching() {
+	ff.m.Lock()
+	defer ff.m.Unlock()
 	select {
 	case <-ff.watching:
 		// Already closed, do nothing
 	default:
-		defer close(ff.watching)
+		// Close our semaphore channel
+		close(ff.watching)
 	}
-	defer ff.watcher.Close()
-	defer ff.lock.Close()
+}
+
+// closeGrace is how long Close waits for waiters to unblock
+const closeGrace = 100 * time.Millisecond
+
+// Close closes the FileFlag and disables its watcher, returning any error from
+// closing the watcher. This will also release all waits. This method is
+// nil-safe, and closing more than once is a no-op.
+func (ff *FileFlag) Close() (err error) {
+	if ff == nil {
+		return
+	}
+	ff.m.Lock()
+	if ff.closed {
+		ff.m.Unlock()
+		return
+	}
+	ff.closed = true
+	ff.m.Unlock()
+
+	// Give anything waiting on us a moment to unblock before we return
+	ctx, cancel := context.WithTimeout(context.Background(), closeGrace)
+	defer cancel()
+	if ff.cycle().CloseWithContext(ctx) != nil {
+		log.Debug("FileFlag closed with waiters still unblocking", "filename", ff.filename)
+	}
+	err = ff.watcher.Close()
+	// Release anything waiting for us to watch
+	ff.signalWatching()
+	return
 }
@@ -1,10 +1,21 @@
 package fileflag_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
 	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
+	"github.com/charmbracelet/log"
+	"github.com/fsnotify/fsnotify"
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
@@ -52,6 +63,91 @@ func remove(path string) (err error) {
 	return
 }
 
+// flakyWatcher is a fakeWatcher which fails to Add with each error in turn
+type flakyWatcher struct {
+	*fakeWatcher
+	addErrs []error
+	adds    int
+}
+
+func (fw *flakyWatcher) Add(name string) error {
+	fw.adds++
+	if len(fw.addErrs) > 0 {
+		err := fw.addErrs[0]
+		fw.addErrs = fw.addErrs[1:]
+		return err
+	}
+	return nil
+}
+
+// scriptedModTime is the modification time of files scriptedStat finds
+var scriptedModTime = time.Date(2023, 10, 1, 0, 0, 0, 0, time.UTC)
+
+// scriptedFileInfo is the os.FileInfo for a file scriptedStat finds
+type scriptedFileInfo struct{ name string }
+
+func (fi scriptedFileInfo) Name() string       { return filepath.Base(fi.name) }
+func (fi scriptedFileInfo) Size() int64        { return 0 }
+func (fi scriptedFileInfo) Mode() os.FileMode  { return 0644 }
+func (fi scriptedFileInfo) ModTime() time.Time { return scriptedModTime }
+func (fi scriptedFileInfo) IsDir() bool        { return false }
+func (fi scriptedFileInfo) Sys() interface{}   { return nil }
+
+// scriptedStat returns a stat function giving each error in turn, with nil
+// meaning the file exists. The last error repeats once the script runs out.
+func scriptedStat(script ...error) func(name string) (os.FileInfo, error) {
+	var m sync.Mutex
+	return func(name string) (os.FileInfo, error) {
+		m.Lock()
+		defer m.Unlock()
+		err := script[0]
+		if len(script) > 1 {
+			script = script[1:]
+		}
+		if err != nil {
+			return nil, &os.PathError{Op: "stat", Path: name, Err: err}
+		}
+		return scriptedFileInfo{name}, nil
+	}
+}
+
+// fakeWatcher is a Watcher which only delivers the events we send it
+type fakeWatcher struct {
+	events   chan fsnotify.Event
+	errors   chan error
+	closeErr error
+}
+
+func newFakeWatcher() *fakeWatcher {
+	return &fakeWatcher{
+		events: make(chan fsnotify.Event),
+		errors: make(chan error),
+	}
+}
+
+func (fw *fakeWatcher) Add(name string) error         { return nil }
+func (fw *fakeWatcher) Close() error                  { return fw.closeErr }
+func (fw *fakeWatcher) Events() <-chan fsnotify.Event { return fw.events }
+func (fw *fakeWatcher) Errors() <-chan error          { return fw.errors }
+
+// lockedBuffer is a bytes.Buffer which is safe to log to from the watcher
+type lockedBuffer struct {
+	buf bytes.Buffer
+	m   sync.Mutex
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.m.Lock()
+	defer b.m.Unlock()
+	return b.buf.String()
+}
+
 var _ = Describe("FileFlag", func() {
 	// TODO: Use unique name
 	var flagPath string
@@ -151,4 +247,1163 @@ var _ = Describe("FileFlag", func() {
 		Eventually(done, 5).Should(BeClosed())
 		ff.Close()
 	})
+
+	Context("with an injected watcher", func() {
+		It("should start on a synthetic create event", func() {
+			started := make(chan interface{})
+			path := tmpPath()
+			flagPath = path
+			fw := newFakeWatcher()
+
+			ff, err := NewFileFlagWithWatcher(path, fw)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+			ff.WaitForWatch()
+
+			go func() {
+				ff.WaitForStart()
+				close(started)
+			}()
+
+			// Nothing exists on disk, so only our event can start the lock
+			fw.events <- fsnotify.Event{Name: path, Op: fsnotify.Create}
+			Eventually(started, 0.1).Should(BeClosed())
+		})
+
+		It("should start promptly when the file is created during setup", func() {
+			path := tmpPath()
+			flagPath = path
+			fw := newFakeWatcher()
+
+			ff, err := NewFileFlagWithWatcher(path, fw)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			// Create the file after the initial check, with no event for it
+			DeferCleanup(SetWatchSetupHook(func() {
+				Expect(touch(path)).To(Succeed())
+			}))
+
+			began := time.Now()
+			go ff.Watch()
+			ff.WaitForStart()
+			Expect(time.Since(began)).To(BeNumerically("<", 100*time.Millisecond))
+			Expect(ff.Resumed()).To(BeFalse())
+		})
+
+		It("should close instead of exiting on a watcher error", func() {
+			path := tmpPath()
+			flagPath = path
+			fw := newFakeWatcher()
+			Expect(touch(path)).To(Succeed())
+
+			ff, err := NewFileFlagWithWatcher(path, fw)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			watched := make(chan interface{})
+			go func() {
+				ff.Watch()
+				close(watched)
+			}()
+			ff.WaitForStart()
+
+			Eventually(fw.errors).Should(BeSent(errors.New("queue overflow")))
+			Eventually(watched).Should(BeClosed())
+			Eventually(ff.Done()).Should(BeClosed())
+		})
+
+		It("should release on a synthetic remove event", func() {
+			done := make(chan interface{})
+			path := tmpPath()
+			flagPath = path
+			fw := newFakeWatcher()
+
+			// The file stays on disk, so only our event can release the lock
+			Expect(touch(path)).To(Succeed())
+
+			ff, err := NewFileFlagWithWatcher(path, fw)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+			ff.WaitForStart()
+
+			go func() {
+				ff.Wait()
+				close(done)
+			}()
+
+			Consistently(done, 0.3).ShouldNot(BeClosed())
+			fw.events <- fsnotify.Event{Name: path, Op: fsnotify.Remove}
+			Eventually(done).Should(BeClosed())
+		})
+
+		Context("StartSource", func() {
+			var path string
+			var fw *fakeWatcher
+			var ff *FileFlag
+
+			BeforeEach(func() {
+				path = tmpPath()
+				flagPath = path
+				fw = newFakeWatcher()
+			})
+
+			// watch starts watching the flag, once the file is in place
+			watch := func() {
+				var err error
+				ff, err = NewFileFlagWithWatcher(path, fw)
+				Expect(err).ToNot(HaveOccurred())
+				DeferCleanup(ff.Close)
+				go ff.Watch()
+				ff.WaitForWatch()
+			}
+
+			It("should be empty before starting", func() {
+				watch()
+				Expect(ff.StartSource()).To(BeEmpty())
+			})
+
+			It("should be event when a file event started it", func() {
+				watch()
+				fw.events <- fsnotify.Event{Name: path, Op: fsnotify.Create}
+				ff.WaitForStart()
+				Expect(ff.StartSource()).To(Equal("event"))
+			})
+
+			It("should be poll when polling found a missed file", func() {
+				watch()
+				// Let Watch get past its setup checks, then create the file
+				// without telling the watcher
+				started := make(chan interface{})
+				go func() {
+					ff.WaitForStart()
+					close(started)
+				}()
+				Consistently(started, 0.05).ShouldNot(BeClosed())
+				Expect(touch(path)).To(Succeed())
+				Eventually(started, 0.5).Should(BeClosed())
+				Expect(ff.StartSource()).To(Equal("poll"))
+			})
+
+			It("should be existing when the file was already there", func() {
+				Expect(touch(path)).To(Succeed())
+				watch()
+				ff.WaitForStart()
+				Expect(ff.StartSource()).To(Equal("existing"))
+			})
+		})
+
+		It("should ignore events for other files", func() {
+			started := make(chan interface{})
+			path := tmpPath()
+			flagPath = path
+			fw := newFakeWatcher()
+
+			ff, err := NewFileFlagWithWatcher(path, fw)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+			ff.WaitForWatch()
+
+			go func() {
+				ff.WaitForStart()
+				close(started)
+			}()
+
+			fw.events <- fsnotify.Event{Name: path + ".other", Op: fsnotify.Create}
+			Consistently(started, 0.1).ShouldNot(BeClosed())
+		})
+
+		Context("logging", func() {
+			var logs *lockedBuffer
+
+			BeforeEach(func() {
+				logs = &lockedBuffer{}
+				log.SetOutput(logs)
+				DeferCleanup(func() {
+					log.SetOutput(os.Stderr)
+					log.SetLevel(log.InfoLevel)
+				})
+			})
+
+			// watchEvents sends each event to a new watched flag at path, which
+			// is closed after the spec
+			watchEvents := func(path string, events ...fsnotify.Event) {
+				fw := newFakeWatcher()
+				ff, err := NewFileFlagWithWatcher(path, fw)
+				Expect(err).ToNot(HaveOccurred())
+				DeferCleanup(ff.Close)
+
+				go ff.Watch()
+				ff.WaitForWatch()
+				for _, event := range events {
+					fw.events <- event
+				}
+			}
+
+			// eventLines counts the logged events for files starting with path
+			eventLines := func(path string) (n int) {
+				for _, line := range strings.Split(logs.String(), "\n") {
+					if strings.Contains(line, "Watcher event") && strings.Contains(line, path) {
+						n++
+					}
+				}
+				return
+			}
+
+			It("should log a debug line per event", func() {
+				log.SetLevel(log.DebugLevel)
+				path := tmpPath()
+				flagPath = path
+				watchEvents(path,
+					fsnotify.Event{Name: path + ".a", Op: fsnotify.Create},
+					fsnotify.Event{Name: path + ".b", Op: fsnotify.Write},
+					fsnotify.Event{Name: path + ".c", Op: fsnotify.Remove},
+				)
+				Eventually(func() int { return eventLines(path) }).Should(Equal(3))
+				Expect(logs.String()).To(ContainSubstring("op=WRITE"))
+			})
+
+			It("should warn about polling before starting at most once", func() {
+				path := tmpPath()
+				flagPath = path
+				watchEvents(path)
+				Eventually(logs.String, 0.5).Should(ContainSubstring("FileFlag timeout"))
+				// Several more poll intervals
+				Consistently(func() int {
+					return strings.Count(logs.String(), "FileFlag timeout")
+				}, 0.7).Should(Equal(1))
+			})
+
+			It("should ignore Chmod events without a state change", func() {
+				log.SetLevel(log.DebugLevel)
+				path := tmpPath()
+				flagPath = path
+				fw := newFakeWatcher()
+				ff, err := NewFileFlagWithWatcher(path, fw)
+				Expect(err).ToNot(HaveOccurred())
+				defer ff.Close()
+
+				go ff.Watch()
+				ff.WaitForWatch()
+				started := make(chan interface{})
+				go func() {
+					ff.WaitForStart()
+					close(started)
+				}()
+
+				fw.events <- fsnotify.Event{Name: path, Op: fsnotify.Chmod}
+				Eventually(logs.String).Should(ContainSubstring("Ignoring Chmod event"))
+				Consistently(started, 0.1).ShouldNot(BeClosed())
+				Expect(ff.Exists()).To(BeFalse())
+
+				// Once started, a Chmod doesn't release us either
+				fw.events <- fsnotify.Event{Name: path, Op: fsnotify.Create}
+				Eventually(started).Should(BeClosed())
+				done := make(chan interface{})
+				go func() {
+					ff.Wait()
+					close(done)
+				}()
+				fw.events <- fsnotify.Event{Name: path, Op: fsnotify.Chmod}
+				Consistently(done, 0.1).ShouldNot(BeClosed())
+			})
+
+			It("should log each poll at debug level", func() {
+				log.SetLevel(log.DebugLevel)
+				path := tmpPath()
+				flagPath = path
+				watchEvents(path)
+				Eventually(logs.String, 0.5).Should(ContainSubstring("Polled flag"))
+			})
+
+			It("should be quiet at info level", func() {
+				path := tmpPath()
+				flagPath = path
+				watchEvents(path, fsnotify.Event{Name: path + ".a", Op: fsnotify.Create})
+				Consistently(func() int { return eventLines(path) }, 0.1).Should(BeZero())
+			})
+		})
+	})
+	Context("Exists", func() {
+		It("should be true when the file is present", func() {
+			path := tmpPath()
+			flagPath = path
+			Expect(touch(path)).To(Succeed())
+
+			ff, err := NewFileFlag(path)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			Expect(ff.Exists()).To(BeTrue())
+			Expect(Check(path)).To(BeTrue())
+		})
+
+		It("should be false when the file is absent", func() {
+			path := tmpPath()
+			flagPath = path
+
+			ff, err := NewFileFlag(path)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			Expect(ff.Exists()).To(BeFalse())
+			Expect(Check(path)).To(BeFalse())
+		})
+	})
+	Context("with a token", func() {
+		It("should not match a stale file from another run", func() {
+			started := make(chan interface{})
+			done := make(chan interface{})
+			path := tmpPath()
+			flagPath = path
+
+			// Leftover flag from a previous run
+			Expect(os.WriteFile(path, []byte("123\nrun-0\n"), 0644)).To(Succeed())
+			Expect(HasToken(path, "run-1")).To(BeFalse())
+
+			ff, err := NewFileFlagWithOptions(path, FileFlagOptions{Token: "run-1"})
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+
+			go func() {
+				ff.WaitForStart()
+				close(started)
+				ff.Wait()
+				close(done)
+			}()
+
+			// Outlast a poll interval to make sure the fallback doesn't match
+			Consistently(started, 0.5).ShouldNot(BeClosed())
+
+			// Our flag replaces the stale one
+			Expect(os.WriteFile(path, []byte("456\nrun-1\n"), 0644)).To(Succeed())
+			Eventually(started).Should(BeClosed())
+
+			Expect(remove(path)).To(Succeed())
+			Eventually(done).Should(BeClosed())
+		})
+	})
+	Context("Close", func() {
+		It("should be safe to call twice", func() {
+			path := tmpPath()
+			flagPath = path
+			fw := newFakeWatcher()
+			fw.closeErr = errors.New("watcher closed")
+
+			ff, err := NewFileFlagWithWatcher(path, fw)
+			Expect(err).ToNot(HaveOccurred())
+
+			go ff.Watch()
+			ff.WaitForWatch()
+
+			Expect(func() {
+				Expect(ff.Close()).To(MatchError("watcher closed"))
+				Expect(ff.Close()).To(Succeed())
+			}).ToNot(Panic())
+		})
+
+		It("should be safe before watching", func() {
+			path := tmpPath()
+			flagPath = path
+
+			ff, err := NewFileFlag(path)
+			Expect(err).ToNot(HaveOccurred())
+
+			Expect(ff.Close()).To(Succeed())
+			Expect(ff.Close()).To(Succeed())
+			// Waits are released
+			ff.WaitForWatch()
+			ff.Wait()
+		})
+
+		It("should cancel WaitForDoneContext, or finish it on close", func() {
+			path := tmpPath()
+			flagPath = path
+			ff, err := NewFileFlagWithWatcher(path, newFakeWatcher())
+			Expect(err).ToNot(HaveOccurred())
+			go ff.Watch()
+			ff.WaitForWatch()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+			defer cancel()
+			Expect(ff.WaitForDoneContext(ctx)).To(MatchError(context.DeadlineExceeded))
+
+			Expect(ff.Close()).To(Succeed())
+			Expect(ff.WaitForDoneContext(context.Background())).To(Succeed())
+		})
+
+		It("should close Done, for waiting in a select", func() {
+			path := tmpPath()
+			flagPath = path
+			ff, err := NewFileFlagWithWatcher(path, newFakeWatcher())
+			Expect(err).ToNot(HaveOccurred())
+			go ff.Watch()
+			ff.WaitForWatch()
+
+			other := make(chan interface{})
+			result := make(chan string)
+			go func() {
+				for {
+					select {
+					case <-other:
+						result <- "other"
+					case <-ff.Done():
+						result <- "done"
+						return
+					}
+				}
+			}()
+
+			other <- struct{}{}
+			Eventually(result).Should(Receive(Equal("other")))
+			Consistently(result, 0.05).ShouldNot(Receive())
+
+			Expect(ff.Close()).To(Succeed())
+			Eventually(result).Should(Receive(Equal("done")))
+		})
+
+		It("should be nil-safe", func() {
+			var ff *FileFlag
+			Expect(ff.Close()).To(Succeed())
+		})
+	})
+	Context("with StaleAfter", func() {
+		It("should release a flag which isn't touched", func() {
+			done := make(chan interface{})
+			path := tmpPath()
+			flagPath = path
+			Expect(touch(path)).To(Succeed())
+
+			ff, err := NewFileFlagWithOptions(path, FileFlagOptions{
+				Watcher:    newFakeWatcher(),
+				StaleAfter: 300 * time.Millisecond,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+			go func() {
+				ff.Wait()
+				close(done)
+			}()
+
+			// The file still exists, but nobody is touching it
+			Eventually(done, 2).Should(BeClosed())
+			Expect(ff.Exists()).To(BeTrue())
+		})
+
+		It("should stay started while the flag is touched", func() {
+			done := make(chan interface{})
+			path := tmpPath()
+			flagPath = path
+			Expect(touch(path)).To(Succeed())
+
+			ff, err := NewFileFlagWithOptions(path, FileFlagOptions{
+				Watcher:    newFakeWatcher(),
+				StaleAfter: 300 * time.Millisecond,
+			})
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+			go func() {
+				ff.Wait()
+				close(done)
+			}()
+
+			// Keep touching the file for longer than the timeout
+			for i := 0; i < 8; i++ {
+				now := time.Now()
+				Expect(os.Chtimes(path, now, now)).To(Succeed())
+				Consistently(done, 0.1).ShouldNot(BeClosed())
+			}
+
+			// Once we stop, it goes stale
+			Eventually(done, 2).Should(BeClosed())
+		})
+	})
+	Context("with atomic replacements", func() {
+		// replace writes content next to path and renames it into place, as
+		// tools rewriting the flag atomically do
+		replace := func(path, content string) {
+			tmp := path + ".tmp"
+			Expect(os.WriteFile(tmp, []byte(content), 0644)).To(Succeed())
+			Expect(os.Rename(tmp, path)).To(Succeed())
+		}
+
+		It("should keep following the path across replacements", func() {
+			path := tmpPath()
+			flagPath = path
+			ff, err := NewFileFlag(path)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+			go ff.Watch()
+			ff.WaitForWatch()
+
+			Expect(touch(path)).To(Succeed())
+			ff.WaitForStart()
+
+			done := make(chan interface{})
+			go func() {
+				ff.Wait()
+				close(done)
+			}()
+			for i := 0; i < 5; i++ {
+				replace(path, "heartbeat "+strconv.Itoa(i))
+				Consistently(done, 0.05).ShouldNot(BeClosed())
+			}
+			// Better than one poll interval, so events saw the replacements
+			Consistently(done, 0.3).ShouldNot(BeClosed())
+
+			Expect(remove(path)).To(Succeed())
+			Eventually(done, 0.5).Should(BeClosed())
+		})
+
+		It("should not release on a rename event while the file is still there", func() {
+			path := tmpPath()
+			flagPath = path
+			fw := newFakeWatcher()
+			ff, err := NewFileFlagWithWatcher(path, fw)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+			Expect(touch(path)).To(Succeed())
+			go ff.Watch()
+			ff.WaitForStart()
+
+			done := make(chan interface{})
+			go func() {
+				ff.Wait()
+				close(done)
+			}()
+			fw.events <- fsnotify.Event{Name: path, Op: fsnotify.Rename}
+			Consistently(done, 0.05).ShouldNot(BeClosed())
+
+			// Once it's really gone, the rename counts
+			Expect(remove(path)).To(Succeed())
+			fw.events <- fsnotify.Event{Name: path, Op: fsnotify.Rename}
+			Eventually(done).Should(BeClosed())
+		})
+	})
+
+	Context("WaitAll", func() {
+		var paths []string
+		var flags []*FileFlag
+
+		BeforeEach(func() {
+			dir := filepath.Dir(tmpPath())
+			paths = nil
+			flags = nil
+			for _, name := range []string{"one", "two", "three"} {
+				path := filepath.Join(dir, name)
+				Expect(touch(path)).To(Succeed())
+				ff, err := NewFileFlag(path)
+				Expect(err).ToNot(HaveOccurred())
+				DeferCleanup(ff.Close)
+				go ff.Watch()
+				ff.WaitForStart()
+
+				paths = append(paths, path)
+				flags = append(flags, ff)
+			}
+		})
+
+		It("should wait for every flag to be removed", func() {
+			done := make(chan interface{})
+			go func() {
+				WaitAll(flags...)
+				close(done)
+			}()
+
+			for _, path := range paths {
+				Consistently(done, 0.1).ShouldNot(BeClosed())
+				Expect(remove(path)).To(Succeed())
+			}
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("should stop waiting when the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+
+			Expect(remove(paths[0])).To(Succeed())
+			Expect(WaitAllContext(ctx, flags...)).To(MatchError(context.DeadlineExceeded))
+		})
+
+		It("should stop waiting on one flag when the context is done", func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+			defer cancel()
+			Expect(flags[0].WaitContext(ctx)).To(MatchError(context.DeadlineExceeded))
+
+			Expect(remove(paths[0])).To(Succeed())
+			Expect(flags[0].WaitContext(context.Background())).To(Succeed())
+		})
+
+		It("should return nil once every flag is removed", func() {
+			for _, path := range paths {
+				Expect(remove(path)).To(Succeed())
+			}
+			Expect(WaitAllContext(context.Background(), flags...)).To(Succeed())
+		})
+	})
+	Context("WaitN", func() {
+		var path string
+		var ff *FileFlag
+
+		BeforeEach(func() {
+			var err error
+			path = tmpPath()
+			flagPath = path
+			ff, err = NewFileFlag(path)
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(ff.Close)
+			go ff.Watch()
+			ff.WaitForWatch()
+		})
+
+		It("should wait for three create and remove cycles", func() {
+			done := make(chan interface{})
+			go func() {
+				ff.WaitN(3)
+				close(done)
+			}()
+
+			for cycle := 1; cycle <= 3; cycle++ {
+				// Each cycle has to be armed before its file comes and goes
+				Eventually(ff.Cycle).Should(Equal(cycle))
+				Expect(touch(path)).To(Succeed())
+				Eventually(ff.StartSource).ShouldNot(BeEmpty())
+				Consistently(done, 0.1).ShouldNot(BeClosed())
+				Expect(remove(path)).To(Succeed())
+			}
+			Eventually(done).Should(BeClosed())
+			Expect(ff.Cycle()).To(Equal(3))
+		})
+
+		It("should stop waiting when closed", func() {
+			done := make(chan interface{})
+			go func() {
+				ff.WaitN(3)
+				close(done)
+			}()
+
+			Expect(touch(path)).To(Succeed())
+			Eventually(ff.StartSource).ShouldNot(BeEmpty())
+			Expect(remove(path)).To(Succeed())
+			Eventually(ff.Cycle).Should(Equal(2))
+
+			Expect(ff.Close()).To(Succeed())
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("should return straight away for no cycles", func() {
+			ff.WaitN(0)
+			Expect(ff.Cycle()).To(Equal(1))
+		})
+	})
+	Context("Resumed", func() {
+		It("should be true when the flag already existed", func() {
+			done := make(chan interface{})
+			path := tmpPath()
+			flagPath = path
+			Expect(touch(path)).To(Succeed())
+
+			ff, err := NewFileFlag(path)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+			ff.WaitForStart()
+			Expect(ff.Resumed()).To(BeTrue())
+
+			// Still behaves normally through to removal
+			go func() {
+				ff.Wait()
+				close(done)
+			}()
+			Expect(remove(path)).To(Succeed())
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("should be false when the flag is created while watching", func() {
+			path := tmpPath()
+			flagPath = path
+
+			ff, err := NewFileFlag(path)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+			ff.WaitForWatch()
+			Expect(touch(path)).To(Succeed())
+			ff.WaitForStart()
+			Expect(ff.Resumed()).To(BeFalse())
+		})
+	})
+
+	Context("WatcherPool", func() {
+		var pool *WatcherPool
+		var paths []string
+		var flags []*FileFlag
+
+		BeforeEach(func() {
+			var err error
+			pool, err = NewWatcherPool()
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(pool.Close)
+
+			dir := GinkgoT().TempDir()
+			paths = nil
+			flags = nil
+			for _, name := range []string{"one", "two", "three"} {
+				path := filepath.Join(dir, name)
+				ff, err := NewFileFlagWithWatcher(path, pool.Watcher())
+				Expect(err).ToNot(HaveOccurred())
+				DeferCleanup(ff.Close)
+				go ff.Watch()
+				ff.WaitForWatch()
+
+				paths = append(paths, path)
+				flags = append(flags, ff)
+			}
+		})
+
+		It("should share one watch for the directory", func() {
+			Expect(pool.Watchers()).To(Equal(3))
+			Expect(pool.Dirs()).To(Equal(1))
+		})
+
+		It("should start and release each flag independently", func() {
+			for i, path := range paths {
+				started := make(chan interface{})
+				go func(ff *FileFlag) {
+					ff.WaitForStart()
+					close(started)
+				}(flags[i])
+
+				// Events should get there well before the poll does
+				Expect(touch(path)).To(Succeed())
+				Eventually(started, 0.15).Should(BeClosed())
+			}
+
+			done := make(chan interface{})
+			go func() {
+				flags[0].Wait()
+				close(done)
+			}()
+			Expect(remove(paths[1])).To(Succeed())
+			Consistently(done, 0.1).ShouldNot(BeClosed())
+			Expect(remove(paths[0])).To(Succeed())
+			Eventually(done).Should(BeClosed())
+		})
+
+		It("should stop watching the directory once every flag is closed", func() {
+			for _, ff := range flags {
+				Expect(ff.Close()).To(Succeed())
+			}
+			Expect(pool.Watchers()).To(Equal(0))
+			Expect(pool.Dirs()).To(Equal(0))
+		})
+
+		It("should only let a pooled watcher watch one directory", func() {
+			w := pool.Watcher()
+			defer w.Close()
+			Expect(w.Add(GinkgoT().TempDir())).To(Succeed())
+			Expect(w.Add(GinkgoT().TempDir())).To(MatchError(ErrPooledAdd))
+		})
+	})
+
+	Context("with WatchMissingDir", func() {
+		var root string
+
+		BeforeEach(func() {
+			root = GinkgoT().TempDir()
+		})
+
+		It("should fail without it when the directory is missing", func() {
+			_, err := NewFileFlag(filepath.Join(root, "missing", "fileflag"))
+			Expect(err).To(HaveOccurred())
+		})
+
+		DescribeTable("starting once the directory is created",
+			func(dirs ...string) {
+				dir := filepath.Join(append([]string{root}, dirs...)...)
+				path := filepath.Join(dir, "fileflag")
+				ff, err := NewFileFlagWithOptions(path, FileFlagOptions{WatchMissingDir: true})
+				Expect(err).ToNot(HaveOccurred())
+				defer ff.Close()
+
+				go ff.Watch()
+				ff.WaitForWatch()
+
+				started := make(chan interface{})
+				go func() {
+					ff.WaitForStart()
+					close(started)
+				}()
+				Consistently(started, 0.1).ShouldNot(BeClosed())
+
+				// Faster than polling, so it must be from watching the
+				// directory once it's there
+				Expect(touch(path)).To(Succeed())
+				Eventually(started, 0.1).Should(BeClosed())
+
+				done := make(chan interface{})
+				go func() {
+					ff.Wait()
+					close(done)
+				}()
+				Expect(remove(path)).To(Succeed())
+				Eventually(done, 0.1).Should(BeClosed())
+			},
+			Entry("for a missing directory", "missing"),
+			Entry("for nested missing directories", "a", "b", "c"),
+		)
+
+		It("should watch the directory when it already exists", func() {
+			path := filepath.Join(root, "fileflag")
+			ff, err := NewFileFlagWithOptions(path, FileFlagOptions{WatchMissingDir: true})
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+			ff.WaitForWatch()
+			Expect(touch(path)).To(Succeed())
+			ff.WaitForStart()
+		})
+	})
+
+	Context("as a semaphore", func() {
+		It("should be watching once New returns", func() {
+			path := tmpPath()
+			flagPath = path
+			latch, err := New(path, FileFlagOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			defer latch.Close()
+
+			Expect(touch(path)).To(Succeed())
+			latch.Acquire()
+			Expect(latch.Release()).To(Succeed())
+			latch.Wait()
+			Expect(latch.Exists()).To(BeFalse())
+		})
+
+		It("should not fail releasing a flag which is already gone", func() {
+			latch, err := New(tmpPath(), FileFlagOptions{})
+			Expect(err).ToNot(HaveOccurred())
+			defer latch.Close()
+			Expect(latch.Release()).To(Succeed())
+		})
+	})
+
+	Context("with PollOnly", func() {
+		It("should start and release from polling alone", func() {
+			path := tmpPath()
+			flagPath = path
+			ff, err := NewFileFlagWithOptions(path, FileFlagOptions{PollOnly: true})
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+			ff.WaitForWatch()
+
+			started := make(chan interface{})
+			go func() {
+				ff.WaitForStart()
+				close(started)
+			}()
+			Expect(touch(path)).To(Succeed())
+			Eventually(started, 0.5).Should(BeClosed())
+
+			done := make(chan interface{})
+			go func() {
+				ff.Wait()
+				close(done)
+			}()
+			Expect(remove(path)).To(Succeed())
+			Eventually(done, 0.5).Should(BeClosed())
+		})
+
+		It("should ignore an injected watcher", func() {
+			path := tmpPath()
+			flagPath = path
+			fw := newFakeWatcher()
+			ff, err := NewFileFlagWithOptions(path, FileFlagOptions{Watcher: fw, PollOnly: true})
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+
+			go ff.Watch()
+			ff.WaitForWatch()
+
+			// Nothing is reading the fake watcher's events
+			Consistently(fw.events, 0.1).ShouldNot(BeSent(fsnotify.Event{Name: path, Op: fsnotify.Create}))
+		})
+	})
+
+	Context("with watch retries", func() {
+		var path string
+		var calls int
+
+		// failingWatchers returns a factory failing with each error in turn,
+		// then creating fake watchers
+		failingWatchers := func(errs ...error) func() (Watcher, error) {
+			return func() (Watcher, error) {
+				calls++
+				if len(errs) > 0 {
+					err := errs[0]
+					errs = errs[1:]
+					return nil, err
+				}
+				return newFakeWatcher(), nil
+			}
+		}
+
+		BeforeEach(func() {
+			path = tmpPath()
+			flagPath = path
+			calls = 0
+		})
+
+		It("should retry creating the watcher when out of resources", func() {
+			DeferCleanup(SetNewWatcher(failingWatchers(syscall.EMFILE), time.Millisecond))
+			ff, err := NewFileFlag(path)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+			Expect(calls).To(Equal(2))
+		})
+
+		It("should return the last error once out of attempts", func() {
+			DeferCleanup(SetNewWatcher(failingWatchers(syscall.EMFILE, syscall.ENOSPC), time.Millisecond))
+			_, err := NewFileFlagWithOptions(path, FileFlagOptions{WatchAttempts: 2})
+			Expect(err).To(MatchError(syscall.ENOSPC))
+			Expect(calls).To(Equal(2))
+		})
+
+		It("should not retry other errors", func() {
+			DeferCleanup(SetNewWatcher(failingWatchers(syscall.EINVAL), time.Millisecond))
+			_, err := NewFileFlag(path)
+			Expect(err).To(MatchError(syscall.EINVAL))
+			Expect(calls).To(Equal(1))
+		})
+
+		It("should retry watching the directory", func() {
+			DeferCleanup(SetNewWatcher(failingWatchers(), time.Millisecond))
+			fw := &flakyWatcher{fakeWatcher: newFakeWatcher(), addErrs: []error{syscall.ENOSPC, syscall.ENOSPC}}
+			ff, err := NewFileFlagWithWatcher(path, fw)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+			Expect(fw.adds).To(Equal(3))
+		})
+	})
+
+	Context("with a slow stat", func() {
+		var hung chan struct{}
+		var armed *atomic.Bool
+		var slowStat func(name string) (os.FileInfo, error)
+
+		BeforeEach(func() {
+			// Once armed, stats hang until we let them go, like a wedged mount
+			hung = make(chan struct{})
+			armed = &atomic.Bool{}
+			release, armed := hung, armed
+			slowStat = func(name string) (os.FileInfo, error) {
+				if armed.Load() {
+					<-release
+				}
+				return os.Stat(name)
+			}
+		})
+
+		It("should keep handling events while the stat hangs", func() {
+			path := tmpPath()
+			flagPath = path
+			fw := newFakeWatcher()
+			ff, err := NewFileFlagWithWatcher(path, fw)
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+			defer close(hung)
+			ff.SetStat(slowStat)
+
+			go ff.Watch()
+			ff.WaitForWatch()
+			// Past the check after signalling, so only polling stats
+			time.Sleep(50 * time.Millisecond)
+			armed.Store(true)
+
+			// Let the poll's stat start and hang, well within its timeout
+			time.Sleep(300 * time.Millisecond)
+			Eventually(fw.events, 0.1).Should(BeSent(fsnotify.Event{Name: path, Op: fsnotify.Create}))
+			Eventually(ff.StartSource, 0.1).Should(Equal("event"))
+		})
+
+		It("should keep handling events while checking a touch hangs", func() {
+			path := tmpPath()
+			flagPath = path
+			fw := newFakeWatcher()
+			ff, err := NewFileFlagWithOptions(path, FileFlagOptions{Watcher: fw, StartOnTouch: true})
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+			defer close(hung)
+			ff.SetStat(slowStat)
+
+			go ff.Watch()
+			ff.WaitForWatch()
+			time.Sleep(50 * time.Millisecond)
+			armed.Store(true)
+
+			// Checking the touch needs the mtime, which hangs, but only the
+			// probe waits for it
+			Eventually(fw.events, 0.1).Should(BeSent(fsnotify.Event{Name: path, Op: fsnotify.Chmod}))
+			for i := 0; i < 3; i++ {
+				Eventually(fw.events, 0.1).Should(BeSent(fsnotify.Event{Name: path, Op: fsnotify.Write}))
+			}
+			Expect(ff.StartSource()).To(BeEmpty())
+		})
+
+		It("should find the file once the stat recovers", func() {
+			path := tmpPath()
+			flagPath = path
+			ff, err := NewFileFlagWithOptions(path, FileFlagOptions{PollOnly: true})
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+			ff.SetStat(slowStat)
+			ff.SetStatTimeout(50 * time.Millisecond)
+
+			go ff.Watch()
+			ff.WaitForWatch()
+			time.Sleep(50 * time.Millisecond)
+			armed.Store(true)
+			Expect(touch(path)).To(Succeed())
+
+			// Polling can't see the file while its stat hangs
+			Consistently(ff.StartSource, 0.5).Should(BeEmpty())
+			armed.Store(false)
+			close(hung)
+			Eventually(ff.StartSource, 1).Should(Equal("poll"))
+		})
+	})
+
+	Context("with a scripted stat", func() {
+		var path string
+		var fw *fakeWatcher
+		var ff *FileFlag
+
+		BeforeEach(func() {
+			// Nothing is ever created on disk, the script decides what exists
+			path = tmpPath()
+			flagPath = path
+			fw = newFakeWatcher()
+			var err error
+			ff, err = NewFileFlagWithWatcher(path, fw)
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(ff.Close)
+		})
+
+		It("should start and release as the file comes and goes", func() {
+			// Missing for the checks on setup, then there for a while
+			ff.SetStat(scriptedStat(os.ErrNotExist, os.ErrNotExist, nil, nil, os.ErrNotExist))
+
+			go ff.Watch()
+			ff.WaitForWatch()
+			Eventually(ff.StartSource, 1).Should(Equal("poll"))
+
+			released := make(chan interface{})
+			go func() {
+				ff.Wait()
+				close(released)
+			}()
+			Eventually(released, 1).Should(BeClosed())
+		})
+
+		It("should resume a file which exists before watching", func() {
+			ff.SetStat(scriptedStat(nil))
+
+			go ff.Watch()
+			ff.WaitForWatch()
+			Expect(ff.Resumed()).To(BeTrue())
+			Expect(ff.StartSource()).To(Equal("existing"))
+		})
+
+		It("should stop watching when the stat fails", func() {
+			ff.SetStat(scriptedStat(os.ErrPermission))
+
+			done := make(chan interface{})
+			go func() {
+				ff.Watch()
+				close(done)
+			}()
+			Eventually(done, 0.5).Should(BeClosed())
+			Expect(ff.StartSource()).To(BeEmpty())
+		})
+
+		It("should treat stat errors as existing", func() {
+			ff.SetStat(scriptedStat(os.ErrNotExist, os.ErrPermission))
+			Expect(ff.Exists()).To(BeFalse())
+			Expect(ff.Exists()).To(BeTrue())
+		})
+
+		It("should use the stat for ModTime", func() {
+			ff.SetStat(scriptedStat(nil, os.ErrNotExist))
+			Expect(ff.ModTime()).To(Equal(scriptedModTime))
+			Expect(ff.ModTime()).To(BeZero())
+		})
+	})
+
+	Context("with StartOnTouch", func() {
+		var path string
+		var ff *FileFlag
+
+		BeforeEach(func() {
+			path = tmpPath()
+			flagPath = path
+			Expect(touch(path)).To(Succeed())
+
+			var err error
+			ff, err = NewFileFlagWithOptions(path, FileFlagOptions{StartOnTouch: true})
+			Expect(err).ToNot(HaveOccurred())
+			DeferCleanup(ff.Close)
+
+			go ff.Watch()
+			ff.WaitForWatch()
+		})
+
+		It("should not start for an existing file", func() {
+			started := make(chan interface{})
+			go func() {
+				ff.WaitForStart()
+				close(started)
+			}()
+			Consistently(started, 0.3).ShouldNot(BeClosed())
+			Expect(ff.Resumed()).To(BeFalse())
+		})
+
+		It("should start when an existing file is touched", func() {
+			started := make(chan interface{})
+			go func() {
+				ff.WaitForStart()
+				close(started)
+			}()
+
+			later := ff.ModTime().Add(time.Second)
+			Expect(os.Chtimes(path, later, later)).To(Succeed())
+			Eventually(started, 0.15).Should(BeClosed())
+			Expect(ff.ModTime()).To(BeTemporally("==", later))
+		})
+	})
+
+	Context("ModTime", func() {
+		It("should be zero for a missing file", func() {
+			ff, err := NewFileFlag(tmpPath())
+			Expect(err).ToNot(HaveOccurred())
+			defer ff.Close()
+			Expect(ff.ModTime().IsZero()).To(BeTrue())
+		})
+	})
 })
@@ -0,0 +1,195 @@
+package fileflag
+
+import (
+	"errors"
+	"path/filepath"
+	"sync"
+
+	"github.com/charmbracelet/log"
+	"github.com/fsnotify/fsnotify"
+)
+
+// poolBuffer is how many events each pooled Watcher can queue before events
+// for it are dropped. FileFlag's polling recovers from dropped events.
+const poolBuffer = 16
+
+var (
+	// ErrPooledAdd is returned when adding a second directory to a pooled
+	// Watcher.
+	ErrPooledAdd = errors.New("pooled watcher can only watch one directory")
+	// ErrPooledClosed is returned when adding to a closed pooled Watcher.
+	ErrPooledClosed = errors.New("pooled watcher is closed")
+)
+
+// WatcherPool shares a single fsnotify.Watcher between many FileFlags, so each
+// directory is only watched once no matter how many flags are in it. Events
+// are demultiplexed to each Watcher by the directory it was added with.
+type WatcherPool struct {
+	w        *fsnotify.Watcher
+	dirs     map[string]int              // dirs counts the Watchers for each directory
+	watchers map[*pooledWatcher]struct{} // watchers are the open Watchers
+	m        sync.Mutex                  // m protects the maps and closing channels
+}
+
+// NewWatcherPool creates a new WatcherPool.
+func NewWatcherPool() (p *WatcherPool, err error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return
+	}
+	p = &WatcherPool{
+		w:        w,
+		dirs:     map[string]int{},
+		watchers: map[*pooledWatcher]struct{}{},
+	}
+	go p.dispatch()
+	return
+}
+
+// Watcher returns a new Watcher sharing the pool, to give to a FileFlag with
+// FileFlagOptions.
+func (p *WatcherPool) Watcher() Watcher {
+	return &pooledWatcher{
+		pool:   p,
+		events: make(chan fsnotify.Event, poolBuffer),
+		errors: make(chan error, 1),
+	}
+}
+
+// Watchers returns how many open Watchers are using our directories.
+func (p *WatcherPool) Watchers() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return len(p.watchers)
+}
+
+// Dirs returns how many directories are being watched.
+func (p *WatcherPool) Dirs() int {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return len(p.dirs)
+}
+
+// Close stops watching every directory, closing all of the pool's Watchers.
+func (p *WatcherPool) Close() error {
+	return p.w.Close()
+}
+
+// dispatch is our goroutine for sending the shared events to each Watcher.
+func (p *WatcherPool) dispatch() {
+	// Once the shared watcher is closed, so are all of ours
+	defer func() {
+		p.m.Lock()
+		defer p.m.Unlock()
+		for pw := range p.watchers {
+			pw.close()
+		}
+		p.watchers = map[*pooledWatcher]struct{}{}
+		p.dirs = map[string]int{}
+	}()
+
+	for {
+		select {
+		case event, ok := <-p.w.Events:
+			if !ok {
+				return
+			}
+			dir := filepath.Dir(event.Name)
+			p.m.Lock()
+			for pw := range p.watchers {
+				if pw.dir != dir {
+					continue
+				}
+				select {
+				case pw.events <- event:
+				default:
+					log.Debug("Dropping event for a busy watcher", "event", event)
+				}
+			}
+			p.m.Unlock()
+		case err, ok := <-p.w.Errors:
+			if !ok {
+				return
+			}
+			p.m.Lock()
+			for pw := range p.watchers {
+				select {
+				case pw.errors <- err:
+				default:
+				}
+			}
+			p.m.Unlock()
+		}
+	}
+}
+
+// pooledWatcher is a Watcher for a single directory in a WatcherPool.
+type pooledWatcher struct {
+	pool   *WatcherPool
+	dir    string
+	events chan fsnotify.Event
+	errors chan error
+	closed bool // closed is protected by the pool's mutex
+}
+
+// Add watches name in the pool, which is only watched once however many
+// Watchers add it. Each pooledWatcher can only watch one directory.
+func (pw *pooledWatcher) Add(name string) (err error) {
+	p := pw.pool
+	p.m.Lock()
+	defer p.m.Unlock()
+	if pw.closed {
+		return ErrPooledClosed
+	}
+	if pw.dir != "" {
+		// Re-adding our own directory is harmless, anything else isn't
+		if pw.dir == name {
+			return
+		}
+		return ErrPooledAdd
+	}
+	if p.dirs[name] == 0 {
+		err = p.w.Add(name)
+		if err != nil {
+			return
+		}
+	}
+	p.dirs[name]++
+	pw.dir = name
+	p.watchers[pw] = struct{}{}
+	return
+}
+
+// Close stops this Watcher, and the pool watching its directory if nothing
+// else is.
+func (pw *pooledWatcher) Close() (err error) {
+	p := pw.pool
+	p.m.Lock()
+	defer p.m.Unlock()
+	if pw.closed {
+		return
+	}
+	if _, ok := p.watchers[pw]; ok {
+		delete(p.watchers, pw)
+		p.dirs[pw.dir]--
+		if p.dirs[pw.dir] == 0 {
+			delete(p.dirs, pw.dir)
+			err = p.w.Remove(pw.dir)
+		}
+	}
+	pw.close()
+	return
+}
+
+// close closes our channels, with the pool's mutex held.
+func (pw *pooledWatcher) close() {
+	if pw.closed {
+		return
+	}
+	pw.closed = true
+	close(pw.events)
+	close(pw.errors)
+}
+
+func (pw *pooledWatcher) Events() <-chan fsnotify.Event { return pw.events }
+func (pw *pooledWatcher) Errors() <-chan error          { return pw.errors }
@@ -0,0 +1,44 @@
+package fileflag
+
+import (
+	"errors"
+	"os"
+)
+
+/*
+ * Semaphore API
+ *
+ * A FileFlag is a named latch shared by every process which can see its file.
+ * Creating the file acquires it, and removing the file releases it, so the
+ * holder and the waiters never need to talk to each other directly. These are
+ * the names to use it by. The watcher oriented names they wrap still work.
+ */
+
+// New creates a FileFlag for filename, and starts watching it so it's ready to
+// Acquire. It's NewFileFlagWithOptions, then Watch and WaitForWatch. Close the
+// FileFlag when you're done with it.
+func New(filename string, opts FileFlagOptions) (ff *FileFlag, err error) {
+	ff, err = NewFileFlagWithOptions(filename, opts)
+	if err != nil {
+		return
+	}
+	go ff.Watch()
+	ff.WaitForWatch()
+	return
+}
+
+// Acquire blocks until the flag file exists, which is when the latch is held.
+// It's WaitForStart.
+func (ff *FileFlag) Acquire() {
+	ff.WaitForStart()
+}
+
+// Release removes the flag file, releasing everything waiting on the latch in
+// any process. A flag file which is already gone isn't an error.
+func (ff *FileFlag) Release() error {
+	err := os.Remove(ff.filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	return err
+}
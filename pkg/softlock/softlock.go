@@ -2,22 +2,32 @@
 package softlock
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // SoftLock implements an idepotent two stage locking mechanism based on
 // channels to allow for asynchronous triggering of waiting goroutines.
 // Once it has been used, it cannot be reused.
 type SoftLock struct {
-	_started bool // _started is a flag to indicate we've started,
+	_started atomic.Bool // _started is a flag to indicate we've started,
 	// which softens the lock further allowing Wait() passthrough without yielding
 	// the running goroutine
 
+	// released and finished mirror the wait and done channels being closed, so
+	// state can be read without touching the channels or mutex
+	released atomic.Bool
+	finished atomic.Bool
+	closed   atomic.Bool // closed is set when Close is what finished us
+
 	started chan interface{} // started gives an explicit signal for try-once semantics
 	wait    chan interface{} // wait is the main lock
 	done    chan interface{} // done is the signal that we're finished, and can exit
-	m       sync.Mutex       // m protects the channels from concurrent access
+	m       sync.Mutex       // m serializes closing the channels
+	waiters atomic.Int32     // waiters is how many goroutines are blocked on us
 }
 
 func (l *SoftLock) String() string {
@@ -26,11 +36,11 @@ func (l *SoftLock) String() string {
 
 // NewSoftLock creates a new SoftLock instance.
 func NewSoftLock() *SoftLock {
+	stats.Add(statCreated, 1)
 	return &SoftLock{
-		_started: false,
-		started:  make(chan interface{}),
-		wait:     make(chan interface{}),
-		done:     make(chan interface{}),
+		started: make(chan interface{}),
+		wait:    make(chan interface{}),
+		done:    make(chan interface{}),
 	}
 }
 
@@ -46,113 +56,178 @@ func (l *SoftLock) Start() bool {
 	default:
 		// Close our semaphore channel
 		close(l.started)
-		l._started = true
-		return l._started
+		l._started.Store(true)
+		stats.Add(statStarted, 1)
+		return true
 	}
 }
 
 // Started returns whether or not we've started our transaction.
 func (l *SoftLock) Started() bool {
-	l.m.Lock()
-	defer l.m.Unlock()
-	return l._started
+	return l._started.Load()
 }
 
 // Release the soft lock allowing waiting goroutines to continue.
 func (l *SoftLock) Release() {
 	l.m.Lock()
 	defer l.m.Unlock()
-	if !l._started {
+	if !l._started.Load() {
 		// If we're not started, we don't release
 		return
 	}
 
 	// We've started, try to release the wait
-	select {
-	case <-l.wait:
-		// Already released, do nothing
-	default:
+	if !l.released.Load() {
 		// Close our wait signal
 		close(l.wait)
+		l.released.Store(true)
+		stats.Add(statReleased, 1)
 	}
 }
 
 // Released returns true if the main wait lock has been released
 func (l *SoftLock) Released() bool {
-	select {
-	case <-l.wait:
-		// Already released
-		return true
-	default:
-		// Not released
-		return false
-	}
+	return l.released.Load()
 }
 
 // Wait for the soft lock to be released. If the lock has not been started, this
 // will be a passthrough.
 func (l *SoftLock) Wait() {
-	l.m.Lock()
-	if !l._started {
-		defer l.m.Unlock()
+	if !l._started.Load() {
 		return
 	}
-	l.m.Unlock()
-	select {
-	case <-l.wait:
+	if l.released.Load() {
 		// Already released, do nothing
-	default:
-		// Wait for the release
-		<-l.wait
+		return
+	}
+	// Wait for the release
+	l.waiters.Add(1)
+	defer l.waiters.Add(-1)
+	<-l.wait
+}
+
+// BlockingWait waits for the soft lock to be released, like Wait, but blocks
+// even if the lock hasn't been started, so it only returns once Release or
+// Close has been called.
+func (l *SoftLock) BlockingWait() {
+	if l.released.Load() {
+		return
 	}
+	l.waiters.Add(1)
+	defer l.waiters.Add(-1)
+	<-l.wait
 }
 
-// Done indicates all the soft lock work is finished, and we can exit.
-func (l *SoftLock) Done() {
+// Waiters returns how many goroutines are currently blocked in Wait,
+// WaitForStart or WaitForDone, or their variants.
+func (l *SoftLock) Waiters() int {
+	return int(l.waiters.Load())
+}
+
+// Done indicates all the soft lock work is finished, and we can exit. It
+// returns true if we finished, and false if we were already finished or if the
+// lock hasn't been released yet, since the lifecycle must go Start, Release,
+// then Done.
+func (l *SoftLock) Done() bool {
+	return l.finish(false)
+}
+
+// finish closes our done signal for Done and Close, recording whether it was
+// Close before anyone waiting for done can see we've finished.
+func (l *SoftLock) finish(closing bool) bool {
 	l.m.Lock()
 	defer l.m.Unlock()
-	select {
-	case <-l.done:
+	if !l.released.Load() {
+		// Not released, we don't finish
+		return false
+	}
+
+	if l.finished.Load() {
 		// Already done, do nothing
-	default:
-		// Close our done signal
-		close(l.done)
+		return false
+	}
+	l.closed.Store(closing)
+	// Close our done signal
+	close(l.done)
+	l.finished.Store(true)
+	stats.Add(statFinished, 1)
+	if closing {
+		stats.Add(statClosed, 1)
 	}
+	return true
 }
 
 // Finished returns true if the lock is finished
 func (l *SoftLock) Finished() bool {
-	select {
-	case <-l.done:
-		// Already done
-		return true
-	default:
-		// Not done
-		return false
-	}
+	return l.finished.Load()
+}
+
+// IsClosed returns true if the lock was finished by Close, rather than by Done
+// after a Release. Closing a lock which is already finished doesn't count.
+func (l *SoftLock) IsClosed() bool {
+	return l.closed.Load()
 }
 
 // Close forces the soft lock to be done, and we can exit.
 func (l *SoftLock) Close() {
 	l.Start()
 	l.Release()
-	l.Done()
+	l.finish(true)
+}
+
+// CloseWithContext forces the soft lock to be done like Close, then waits until
+// there are no Waiters left, so callers know everyone has unblocked. It returns
+// ctx.Err() if ctx is done before then.
+func (l *SoftLock) CloseWithContext(ctx context.Context) error {
+	l.Close()
+
+	ticker := time.NewTicker(time.Millisecond)
+	defer ticker.Stop()
+	for l.Waiters() > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
 }
 
 // WaitForDone waits for the soft lock to completely finish its lifecycle. This
 // will block regardless of whether the lock has started or not.
 func (l *SoftLock) WaitForDone() {
+	l.waiters.Add(1)
+	defer l.waiters.Add(-1)
 	<-l.done
 }
 
+// WaitForDoneContext waits for the soft lock to finish, as WaitForDone does,
+// or until ctx is done, returning ctx.Err().
+func (l *SoftLock) WaitForDoneContext(ctx context.Context) error {
+	l.waiters.Add(1)
+	defer l.waiters.Add(-1)
+	select {
+	case <-l.done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// DoneChan returns a channel which is closed once the soft lock is finished,
+// for waiting on it in a select alongside other events, as WaitForDone would.
+// Goroutines waiting on it aren't counted in Waiters.
+func (l *SoftLock) DoneChan() <-chan interface{} {
+	return l.done
+}
+
 // WaitForStart waits for the soft lock to start. If the lock has already been
 // started, this will be a passthrough.
 func (l *SoftLock) WaitForStart() {
-	l.m.Lock()
-	if l._started {
-		defer l.m.Unlock()
+	if l._started.Load() {
 		return
 	}
-	l.m.Unlock()
+	l.waiters.Add(1)
+	defer l.waiters.Add(-1)
 	<-l.started
 }
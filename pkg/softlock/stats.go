@@ -0,0 +1,48 @@
+package softlock
+
+import (
+	"expvar"
+	"sync"
+)
+
+// stats counts lifecycle events across every SoftLock. It's an unpublished
+// expvar.Map, so counting needs no global registration until Publish.
+var stats = new(expvar.Map).Init()
+
+// The lifecycle events counted in stats
+const (
+	statCreated  = "created"  // NewSoftLock made a lock
+	statStarted  = "started"  // Start started a lock
+	statReleased = "released" // Release released a lock
+	statFinished = "finished" // Done or Close finished a lock
+	statClosed   = "closed"   // Close is what finished a lock
+)
+
+// statNames are all of the events in stats, so Counts has every one
+var statNames = []string{statCreated, statStarted, statReleased, statFinished, statClosed}
+
+var publishOnce sync.Once
+
+// Publish exposes the counts of SoftLock lifecycle events across the process
+// with expvar under name, e.g. for scraping from /debug/vars. Counting always
+// happens, but nothing is published unless this is called. Only the first call
+// publishes; expvar can't publish the same counts twice.
+func Publish(name string) {
+	publishOnce.Do(func() {
+		expvar.Publish(name, stats)
+	})
+}
+
+// Counts returns how many times each lifecycle event has happened across every
+// SoftLock in the process, keyed by "created", "started", "released",
+// "finished" and "closed".
+func Counts() map[string]int64 {
+	counts := map[string]int64{}
+	for _, name := range statNames {
+		counts[name] = 0
+		if count, ok := stats.Get(name).(*expvar.Int); ok {
+			counts[name] = count.Value()
+		}
+	}
+	return counts
+}